@@ -0,0 +1,216 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ActiveProbesEnabled reports whether any probe that continues the handshake
+// on the open connection has been requested.
+func ActiveProbesEnabled(config Config) bool {
+	return config.TLS || config.AuthFile != "" || config.CheckAnonymous || config.PublicKey
+}
+
+// ActiveProber runs the probes enabled in config on connections whose
+// greeting has been captured.
+type ActiveProber struct {
+	config      Config
+	credentials []Credential
+}
+
+func NewActiveProber(config Config) (*ActiveProber, error) {
+	prober := &ActiveProber{config: config}
+	if config.AuthFile != "" {
+		credentials, err := LoadCredentials(config.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		prober.credentials = credentials
+	}
+	return prober, nil
+}
+
+// Run continues the handshake on conn after its greeting was received as
+// mysqlinformation, and records the outcome of each enabled probe. consumed
+// is the greeting packet if it was already read from conn, or nil if it was
+// captured and is still to be read.
+func (p *ActiveProber) Run(conn net.Conn, mysqlinformation MySQlInformation, consumed []byte) MySQlInformation {
+	session := NewSession(conn, time.Duration(p.config.Timeout)*time.Second)
+	var greeting MySQlInformation
+	var err error
+	if consumed != nil {
+		greeting, err = session.ResumeGreeting(consumed)
+	} else {
+		greeting, err = session.ReadGreeting()
+	}
+	if err != nil {
+		return mysqlinformation
+	}
+
+	// Each probe consumes a connection, so only the first can use the open
+	// connection and the rest reconnect. Logins follow the TLS setting, while
+	// public keys are only handed out over plaintext.
+	held := session
+
+	// Upgrade to TLS. Credentials are not sent in plaintext when the upgrade
+	// fails, while the public key request never sends one.
+	var loginError string
+	if p.config.TLS && mysqlinformation.ServerCapabilities.SWITCHTOSSLAFTERHANDSHAKE {
+		tlsinformation, err := session.StartTLS(p.config.TLSServerName)
+		if err != nil {
+			tlsinformation.Errormessage = err.Error()
+			session.Conn.Close()
+			held = nil
+			loginError = "TLS upgrade failed, not sending credentials in plaintext"
+		}
+		mysqlinformation.TLS = tlsinformation
+	}
+	useTLS := session.tls
+	open := func(tls bool) (*Session, MySQlInformation, error) {
+		if held != nil && held.tls == tls {
+			opened := held
+			held = nil
+			return opened, greeting, nil
+		}
+		return p.reconnect(mysqlinformation, tls)
+	}
+	login := func(credential Credential) (AuthResult, *Session) {
+		if loginError != "" {
+			return AuthResult{Username: credential.Username, Errormessage: loginError}, nil
+		}
+		loginSession, loginGreeting, err := open(useTLS)
+		if err != nil {
+			return AuthResult{Username: credential.Username, Errormessage: err.Error()}, nil
+		}
+		result := loginSession.Authenticate(loginGreeting, credential)
+		if !result.Success {
+			loginSession.Conn.Close()
+			return result, nil
+		}
+		return result, loginSession
+	}
+
+	// Check Anonymous Logins
+	if p.config.CheckAnonymous {
+		anonymous := &AnonymousAccess{Errormessage: loginError}
+		usernames := anonymousUsernames
+		if loginError != "" {
+			usernames = nil
+		}
+		for _, username := range usernames {
+			result, authenticated := login(Credential{Username: username})
+			anonymous.Attempts = append(anonymous.Attempts, result)
+			if authenticated != nil {
+				anonymous.Accepted = true
+				anonymous.Username = username
+				anonymous.queryServerInformation(authenticated)
+				p.queryVariables(authenticated, &mysqlinformation)
+				authenticated.Conn.Close()
+				break
+			}
+		}
+		mysqlinformation.Anonymous = anonymous
+	}
+
+	// Attempt Credentials
+	for _, credential := range p.credentials {
+		result, authenticated := login(credential)
+		mysqlinformation.Authentication = append(mysqlinformation.Authentication, result)
+		if authenticated != nil {
+			p.queryVariables(authenticated, &mysqlinformation)
+			authenticated.Conn.Close()
+		}
+	}
+
+	// Request Public Key
+	if p.config.PublicKey && publicKeyPlugins[mysqlinformation.AuthenticationPlugin] {
+		keySession, keyGreeting, err := open(false)
+		if err != nil {
+			mysqlinformation.PublicKey = &PublicKeyInformation{Errormessage: err.Error()}
+		} else {
+			mysqlinformation.PublicKey = keySession.RequestPublicKey(keyGreeting)
+			keySession.Conn.Close()
+		}
+	}
+
+	return mysqlinformation
+}
+
+// queryVariables runs the configured queries on the first authenticated
+// session to a server and records their results. The queries run in a
+// read-only transaction, and are skipped if the server cannot start one.
+func (p *ActiveProber) queryVariables(session *Session, mysqlinformation *MySQlInformation) {
+	if mysqlinformation.Variables != nil || len(p.config.Queries) == 0 {
+		return
+	}
+	mysqlinformation.Variables = make(map[string]string)
+	queryError := func(query string, err error) {
+		if mysqlinformation.QueryErrors == nil {
+			mysqlinformation.QueryErrors = make(map[string]string)
+		}
+		mysqlinformation.QueryErrors[query] = err.Error()
+	}
+	for _, statement := range readOnlyTransaction {
+		if _, err := session.Query(statement); err != nil {
+			queryError(statement, err)
+			return
+		}
+	}
+	for _, query := range p.config.Queries {
+		resultset, err := session.Query(query)
+		if err != nil {
+			queryError(query, err)
+			continue
+		}
+		for name, value := range resultset.Variables() {
+			mysqlinformation.Variables[name] = value
+		}
+	}
+}
+
+// reconnect opens a new session to the server behind mysqlinformation, reads
+// its greeting and, if useTLS is set, upgrades it to TLS.
+func (p *ActiveProber) reconnect(mysqlinformation MySQlInformation, useTLS bool) (*Session, MySQlInformation, error) {
+	ipaddress := net.ParseIP(mysqlinformation.IPAddress)
+	localAddress := p.config.SourceAddr6
+	if ipaddress.To4() != nil {
+		localAddress = p.config.SourceAddr4
+	}
+	timeout := time.Duration(p.config.Timeout) * time.Second
+	dialer := net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: net.ParseIP(localAddress)}}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(mysqlinformation.IPAddress, mysqlinformation.DstPort))
+	if err != nil {
+		return nil, MySQlInformation{}, err
+	}
+
+	session := NewSession(conn, timeout)
+	greeting, err := session.ReadGreeting()
+	if err == nil && greeting.Sqlerror {
+		err = errors.New(greeting.Errormessage)
+	}
+	if err == nil && useTLS {
+		_, err = session.StartTLS(p.config.TLSServerName)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, greeting, err
+	}
+	return session, greeting, nil
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+)
+
+// authRoundLimit bounds the number of packets exchanged after the
+// HandshakeResponse41 before the attempt is abandoned.
+const authRoundLimit = 8
+
+// Credential is a username and password to attempt logging in with.
+type Credential struct {
+	Username string
+	Password string
+}
+
+// AuthResult records the outcome of one login attempt. The password is never
+// recorded.
+type AuthResult struct {
+	Username     string
+	Plugin       string
+	AuthSwitch   string `json:",omitempty"`
+	Success      bool
+	Errorcode    uint16 `json:",omitempty"`
+	SQLState     string `json:",omitempty"`
+	Errormessage string `json:",omitempty"`
+}
+
+// anonymousUsernames are tried with an empty password by --check-anonymous.
+var anonymousUsernames = []string{"", "root"}
+
+// serverInformationQuery is run once an anonymous login has been accepted.
+const serverInformationQuery = "SELECT @@version, @@hostname, @@version_comment"
+
+// AnonymousAccess records whether the server accepted a login with an empty
+// password, and if so, what it reported about itself.
+type AnonymousAccess struct {
+	Accepted       bool
+	Username       string `json:",omitempty"`
+	Version        string `json:",omitempty"`
+	Hostname       string `json:",omitempty"`
+	VersionComment string `json:",omitempty"`
+	Errormessage   string `json:",omitempty"`
+	Attempts       []AuthResult
+}
+
+// queryServerInformation records the server's version and hostname from an
+// accepted anonymous session.
+func (a *AnonymousAccess) queryServerInformation(session *Session) {
+	resultset, err := session.Query(serverInformationQuery)
+	if err != nil {
+		a.Errormessage = err.Error()
+		return
+	}
+	if len(resultset.Rows) == 0 || len(resultset.Rows[0]) != 3 {
+		a.Errormessage = "unexpected result for " + serverInformationQuery
+		return
+	}
+	a.Version = resultset.Rows[0][0]
+	a.Hostname = resultset.Rows[0][1]
+	a.VersionComment = resultset.Rows[0][2]
+}
+
+// LoadCredentials reads user:password pairs, one per line. The password is
+// everything after the first colon, so it may itself contain colons. Blank
+// lines and lines starting with # are skipped.
+func LoadCredentials(path string) ([]Credential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var credentials []Credential
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errors.New("credential is not a user:password pair: " + line)
+		}
+		credentials = append(credentials, Credential{Username: username, Password: password})
+	}
+	return credentials, scanner.Err()
+}
+
+// Authenticate answers the greeting with a HandshakeResponse41 for
+// credential, following any AuthSwitchRequest and the extra rounds of
+// caching_sha2_password and sha256_password. Passwords are only sent in the
+// clear over TLS; otherwise they are encrypted with the server's public key.
+func (s *Session) Authenticate(greeting MySQlInformation, credential Credential) AuthResult {
+	plugin := greeting.AuthenticationPlugin
+	if _, err := authResponse(plugin, credential.Password, nil, false); err != nil {
+		// Let the server switch us to the plugin it wants
+		plugin = "mysql_native_password"
+	}
+	salt := append(append([]byte(nil), greeting.Salt1...), greeting.Salt2...)
+	result := AuthResult{Username: credential.Username, Plugin: plugin}
+
+	response, err := authResponse(plugin, credential.Password, salt, s.tls)
+	if err == nil {
+		err = s.WritePacket(handshakeResponse(credential.Username, plugin, response, s.tls))
+	}
+
+	for round := 0; err == nil; round++ {
+		if round == authRoundLimit {
+			err = errors.New("too many authentication rounds")
+			break
+		}
+		var packet []byte
+		if packet, err = s.ReadPacket(); err != nil {
+			break
+		}
+		if len(packet) < 5 {
+			err = errors.New("empty authentication packet")
+			break
+		}
+
+		switch packet[4] {
+		case 0x00:
+			// OK
+			result.Success = true
+			return result
+
+		case 0xff:
+			// ERR
+			errorinformation, _ := ParseMySQLError(packet)
+			result.Errorcode = errorinformation.Errorcode
+			result.SQLState = errorinformation.SQLState
+			result.Errormessage = errorinformation.Errormessage
+			return result
+
+		case 0xfe:
+			// AuthSwitchRequest
+			reader := payloadReader{payload: packet, offset: 5}
+			if plugin, err = reader.readNullString(false); err != nil {
+				break
+			}
+			data, _ := reader.next(reader.remaining())
+			salt = bytes.TrimRight(data, "\x00")
+			result.AuthSwitch = plugin
+			if response, err = authResponse(plugin, credential.Password, salt, s.tls); err == nil {
+				err = s.WritePacket(response)
+			}
+
+		case 0x01:
+			// AuthMoreData
+			data := packet[5:]
+			switch {
+			case len(data) == 1 && data[0] == 0x03:
+				// Fast authentication succeeded, OK follows
+			case len(data) == 1 && data[0] == 0x04:
+				// Full authentication
+				if s.tls {
+					err = s.WritePacket(append([]byte(credential.Password), 0))
+				} else {
+					err = s.WritePacket([]byte{0x02})
+				}
+			default:
+				// Public key
+				if response, err = encryptPassword(credential.Password, salt, data); err == nil {
+					err = s.WritePacket(response)
+				}
+			}
+
+		default:
+			err = errors.New("unexpected authentication packet")
+		}
+	}
+
+	result.Errormessage = err.Error()
+	return result
+}
+
+// handshakeResponse builds a HandshakeResponse41.
+func handshakeResponse(username string, plugin string, response []byte, tls bool) []byte {
+	capabilities := uint32(clientLongPassword | clientProtocol41 | clientSecureConnection | clientPluginAuth)
+	if tls {
+		capabilities |= clientSSL
+	}
+
+	packet := make([]byte, 32, 32+len(username)+len(response)+len(plugin)+3)
+	binary.LittleEndian.PutUint32(packet[0:4], capabilities)
+	binary.LittleEndian.PutUint32(packet[4:8], maxPacketLength)
+	packet[8] = 0x21
+	packet = append(packet, username...)
+	packet = append(packet, 0, byte(len(response)))
+	packet = append(packet, response...)
+	packet = append(packet, plugin...)
+	return append(packet, 0)
+}
+
+// authResponse computes the first authentication response for plugin.
+func authResponse(plugin string, password string, salt []byte, tls bool) ([]byte, error) {
+	switch plugin {
+	case "mysql_native_password":
+		return scrambleNativePassword(password, salt), nil
+	case "caching_sha2_password":
+		return scrambleSHA256Password(password, salt), nil
+	case "sha256_password":
+		if password == "" {
+			return []byte{0x00}, nil
+		} else if tls {
+			return append([]byte(password), 0), nil
+		}
+		// Request the public key
+		return []byte{0x01}, nil
+	}
+	return nil, errors.New("unsupported authentication plugin: " + plugin)
+}
+
+// scrambleNativePassword computes
+// SHA1(password) XOR SHA1(salt + SHA1(SHA1(password))).
+func scrambleNativePassword(password string, salt []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	hash := sha1.New()
+	hash.Write(salt)
+	hash.Write(stage2[:])
+	scramble := hash.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+// scrambleSHA256Password computes
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt).
+func scrambleSHA256Password(password string, salt []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	hash := sha256.New()
+	hash.Write(stage2[:])
+	hash.Write(salt)
+	scramble := hash.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+// parsePublicKey decodes the PEM encoded RSA key sent by the server.
+func parsePublicKey(data []byte) (*rsa.PublicKey, *pem.Block, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM public key in authentication packet")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		return key, block, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, block, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, block, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, block, nil
+}
+
+// encryptPassword XORs the NUL terminated password with the salt and
+// encrypts it with the server's public key using RSA-OAEP.
+func encryptPassword(password string, salt []byte, pemKey []byte) ([]byte, error) {
+	key, _, err := parsePublicKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) == 0 {
+		return nil, errors.New("no salt to encrypt password with")
+	}
+	plaintext := append([]byte(password), 0)
+	for i := range plaintext {
+		plaintext[i] ^= salt[i%len(salt)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, key, plaintext, nil)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+)
+
+// xorBytes returns a XOR b, which must be the same length.
+func xorBytes(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+func TestAuthenticate(t *testing.T) {
+	credential := Credential{Username: "scanner", Password: "secret"}
+
+	passwordSHA1 := sha1.Sum([]byte(credential.Password))
+	doubleSHA1 := sha1.Sum(passwordSHA1[:])
+	saltedSHA1 := sha1.Sum(append(append([]byte(nil), testSalt...), doubleSHA1[:]...))
+	nativeScramble := xorBytes(passwordSHA1[:], saltedSHA1[:])
+
+	passwordSHA256 := sha256.Sum256([]byte(credential.Password))
+	doubleSHA256 := sha256.Sum256(passwordSHA256[:])
+	saltedSHA256 := sha256.Sum256(append(doubleSHA256[:], testSalt...))
+	cachingScramble := xorBytes(passwordSHA256[:], saltedSHA256[:])
+
+	tests := []struct {
+		name     string
+		plugin   string
+		scramble []byte
+		replies  [][]byte
+		want     AuthResult
+	}{
+		{
+			name:     "native password",
+			plugin:   "mysql_native_password",
+			scramble: nativeScramble,
+			replies:  [][]byte{okPacket},
+			want:     AuthResult{Username: "scanner", Plugin: "mysql_native_password", Success: true},
+		},
+		{
+			name:     "caching_sha2_password fast authentication",
+			plugin:   "caching_sha2_password",
+			scramble: cachingScramble,
+			replies:  [][]byte{{0x01, 0x03}, okPacket},
+			want:     AuthResult{Username: "scanner", Plugin: "caching_sha2_password", Success: true},
+		},
+		{
+			name:     "access denied",
+			plugin:   "mysql_native_password",
+			scramble: nativeScramble,
+			replies:  [][]byte{accessDenied},
+			want: AuthResult{Username: "scanner", Plugin: "mysql_native_password", Errorcode: 1045,
+				SQLState: "28000", Errormessage: "Access denied for user"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			greeting, err := ParseGreeting(testGreeting(test.plugin, 0))
+			if err != nil {
+				t.Fatalf("ParseGreeting: %v", err)
+			}
+			session := pipeSession(t, func(server fakeServer) {
+				payload := server.readPacket(1)
+				if payload == nil {
+					return
+				}
+				username, response, plugin := handshakeResponseFields(t, payload)
+				if username != credential.Username || plugin != test.plugin {
+					t.Errorf("got username %q and plugin %q", username, plugin)
+				}
+				if !bytes.Equal(response, test.scramble) {
+					t.Errorf("got scramble %x, want %x", response, test.scramble)
+				}
+				for i, reply := range test.replies {
+					server.writePacket(byte(2+i), reply)
+				}
+			})
+
+			if got := session.Authenticate(greeting, credential); got != test.want {
+				t.Errorf("Authenticate() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -17,24 +17,86 @@ limitations under the License.
 package bin
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
 	"mysqlscanner"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
 )
 
+var outputLock sync.Mutex
+
 func check(e error) {
 	if e != nil {
 		log.Fatalln(e)
 	}
 }
 
+// writeJSON writes a single result to stdout as one line of JSON. It is safe
+// to call from multiple goroutines.
+func writeJSON(object interface{}) {
+	jsonData, err := json.Marshal(object)
+	check(err)
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	_, err = os.Stdout.Write(append(jsonData, '\n'))
+	check(err)
+}
+
+// writeResult writes a MySQL result, reducing errors to the fields that
+// apply to them.
+func writeResult(ipStr mysqlscanner.MySQlInformation) {
+	var record interface{}
+	if ipStr.Parseerror == true {
+		record = mysqlscanner.ParseError{IPAddress: ipStr.IPAddress, DstPort: ipStr.DstPort, Issql: ipStr.Issql, Parseerror: ipStr.Parseerror, Errormessage: ipStr.Errormessage, RawPayload: ipStr.RawPayload}
+	} else if ipStr.Sqlerror == true {
+		ipErrorObject := mysqlscanner.MySQLError{}
+		ipErrorObject.IPAddress = ipStr.IPAddress
+		ipErrorObject.DstPort = ipStr.DstPort
+		ipErrorObject.Issql = ipStr.Issql
+		ipErrorObject.Sqlerror = ipStr.Sqlerror
+		ipErrorObject.Errorcode = ipStr.Errorcode
+		ipErrorObject.SQLState = ipStr.SQLState
+		ipErrorObject.ErrorClass = ipStr.ErrorClass
+		ipErrorObject.Errormessage = ipStr.Errormessage
+		record = ipErrorObject
+	} else {
+		record = ipStr
+	}
+	writeJSON(mysqlscanner.NewEnvelope(ipStr.IPAddress, ipStr.DstPort, "MySQL", record))
+}
+
+// writeError writes a target that could not be probed. The error is recorded
+// under the module's name like any other record.
+func writeError(ipaddress string, port string, module string, errormessage string) {
+	writeJSON(mysqlscanner.NewEnvelope(ipaddress, port, module, mysqlscanner.TCPErrorStruct{IPAddress: ipaddress, Issql: false, DstPort: port, Errormessage: errormessage}))
+}
+
+// resultModule returns the module a result belongs to. Refused handshakes
+// carry no module, so the port's default is used for them.
+func resultModule(result mysqlscanner.Result) string {
+	if result.Module != "" {
+		return result.Module
+	}
+	port, _ := strconv.Atoi(result.DstPort)
+	return mysqlscanner.ModuleForPort(port).Name()
+}
+
+// resultKey returns the connection table key for a result.
+func resultKey(result mysqlscanner.Result) string {
+	ipaddress := net.ParseIP(result.IPAddress)
+	if ipaddress.To4() != nil {
+		return ipaddress.String() + ":" + result.DstPort
+	}
+	return "[" + ipaddress.String() + "]" + ":" + result.DstPort
+}
+
 func connectTCP(address string, timeout int, networkString string, localAddress string) (net.Conn, error) {
 
 	localAddr := &net.TCPAddr{IP: net.ParseIP(localAddress)}
@@ -61,118 +123,144 @@ func MySQLScannerMain() {
 		}
 		check(err)
 	}
+	if options, ok := mysqlscanner.ReplayRequested(); ok {
+		replayMain(config, options)
+		return
+	}
 
 	// Check Config Inputs
 	validIP4, validIP6 := mysqlscanner.ValidateConfig(config)
 
-	// Create PCAP Listener
-	pcapChannel := make(chan mysqlscanner.MySQlInformation, 100000)
-	setupChannel := make(chan string, 100000)
-	go func() {
-		mysqlscanner.ListenForPCAP(config, pcapChannel, setupChannel, validIP4, validIP6)
-	}()
-
-	setupConfirmed := <-setupChannel
-	if setupConfirmed == "setup" {
-		log.Info("Setup PCAP Listener")
-		if validIP4 {
-			log.Info("Listening on IPv4 Address")
-		}
-		if validIP6 {
-			log.Info("Listening on IPv6 Address")
-		}
-	} else {
-		log.Fatal("Error Setting Up PCAP Listener")
-		return
+	// Create Raw Sender
+	probes := mysqlscanner.NewProbeTable()
+	var sender *mysqlscanner.RawSender
+	if config.Mode == "raw" {
+		sender, err = mysqlscanner.NewRawSender(config, probes)
+		check(err)
+		defer sender.Close()
+		log.Info("Sending Raw SYN Packets")
 	}
 
-	// Load STDIN File:
-	inputFile := os.Stdin
-	inputBuffer := bufio.NewReader(inputFile)
-
-	// Read From STDIN and send TCP Handshake
-	connections := make(map[string]net.Conn)
-
-	log.Info("Commencing Sending")
-	for {
-		line, err := inputBuffer.ReadString('\n')
-		if err == io.EOF {
-			if line == "" {
-				break
-			}
-		} else if err != nil {
-			break
-		}
+	// Load Active Probes
+	prober, err := mysqlscanner.NewActiveProber(config)
+	check(err)
 
-		ipaddressString, port, networkString, inputLocalAddress := mysqlscanner.ParseNetStringAndIP(config, line, validIP4, validIP6)
-		if ipaddressString == "" {
-			continue
+	// Create PCAP Listener
+	pcapChannel := make(chan mysqlscanner.Result, 100000)
+	if config.Recv == "socket" {
+		log.Info("Reading Handshakes From Sockets")
+	} else {
+		var tee *mysqlscanner.PCAPWriter
+		if config.PCAPOut != "" {
+			tee, err = mysqlscanner.NewPCAPWriter(config.PCAPOut)
+			check(err)
+			defer tee.Close()
 		}
+		setupChannel := make(chan string, 100000)
+		go func() {
+			mysqlscanner.ListenForPCAP(config, pcapChannel, setupChannel, validIP4, validIP6, sender, probes, tee)
+		}()
 
-		conn, err := connectTCP(ipaddressString+":"+port, config.Timeout, networkString, inputLocalAddress)
-
-		if err != nil {
-			objectToWrite := mysqlscanner.TCPErrorStruct{IPAddress: ipaddressString[1 : len(ipaddressString)-1], Issql: false, DstPort: port, Errormessage: err.Error()}
-			jsonData, err0 := json.Marshal(objectToWrite)
-			check(err0)
-			_, err1 := os.Stdout.Write(jsonData)
-			check(err1)
-			_, err2 := os.Stdout.Write([]byte{'\n'})
-			check(err2)
+		setupConfirmed := <-setupChannel
+		if setupConfirmed == "setup" {
+			log.Info("Setup PCAP Listener")
+			if validIP4 {
+				log.Info("Listening on IPv4 Address")
+			}
+			if validIP6 {
+				log.Info("Listening on IPv6 Address")
+			}
 		} else {
-			connections[ipaddressString+":"+port] = conn
+			log.Fatal("Error Setting Up PCAP Listener")
+			return
 		}
 	}
 
+	// Read From STDIN and send TCP Handshakes concurrently
+	connections := newConnectionTable(probes)
+	targets := make(chan target, config.Senders)
+	sendDone := make(chan struct{})
+
+	log.Info("Commencing Sending")
+	go readTargets(config, os.Stdin, validIP4, validIP6, targets)
+	go func() {
+		sendTargets(config, targets, connections, sender, pcapChannel)
+		close(sendDone)
+	}()
+
 	// Return Responses
+	var probing sync.WaitGroup
+	probeSlots := make(chan struct{}, config.Senders)
+	sending := true
 	for loop := true; loop; {
-		if len(connections) == 0 {
+		if !sending && connections.len() == 0 {
 			break
 		}
+
+		// The cooldown only starts once every target has been sent
+		var cooldown <-chan time.Time
+		if !sending {
+			cooldown = time.After(time.Duration(config.Cooldown) * 1000 * time.Millisecond)
+		}
+
 		select {
-		case ipStr := <-pcapChannel:
-			if ipStr.Issql == true {
-				ipaddress := net.ParseIP(ipStr.IPAddress)
-				ipParsingString := ""
-				if ipaddress.To4() != nil {
-					ipParsingString = ipaddress.String() + ":" + ipStr.DstPort
-				} else {
-					ipParsingString = "[" + ipaddress.String() + "]" + ":" + ipStr.DstPort
-				}
-				ipErrorObject := mysqlscanner.MySQLError{}
-				var jsonData []byte
-				if ipStr.Sqlerror == true {
-					ipErrorObject.IPAddress = ipStr.IPAddress
-					ipErrorObject.DstPort = ipStr.DstPort
-					ipErrorObject.Issql = ipStr.Issql
-					ipErrorObject.Sqlerror = ipStr.Sqlerror
-					ipErrorObject.Errorcode = ipStr.Errorcode
-					ipErrorObject.Errormessage = ipStr.Errormessage
-					jsonData, err = json.Marshal(ipErrorObject)
-					check(err)
-				} else {
-					jsonData, err = json.Marshal(ipStr)
-					check(err)
+		case result := <-pcapChannel:
+			ipStr, isMySQL := result.Record.(mysqlscanner.MySQlInformation)
+			ipStr.IPAddress = result.IPAddress
+			ipStr.DstPort = result.DstPort
+			if result.Errormessage != "" {
+				// Raw mode handshake refused by the target
+				connections.remove(resultKey(result))
+				writeError(result.IPAddress, result.DstPort, resultModule(result), result.Errormessage)
+			} else if result.Record != nil && !isMySQL {
+				connections.remove(resultKey(result))
+				writeJSON(mysqlscanner.NewEnvelope(result.IPAddress, result.DstPort, result.Module, result.Record))
+			} else if ipStr.Issql == true && ipStr.Sqlerror == false && ipStr.Parseerror == false && config.Mode != "raw" && mysqlscanner.ActiveProbesEnabled(config) {
+				// Continue the handshake on the open connection before recording
+				// it, waiting for the dial if the greeting was captured first
+				entry := connections.take(resultKey(result))
+				if entry == nil {
+					ipStr.Errormessage = errProbesSkipped
+					writeResult(ipStr)
+					continue
 				}
-				connections[ipParsingString].Close()
-				delete(connections, ipParsingString)
-
-				_, err = os.Stdout.Write(jsonData)
-				check(err)
-				_, err2 := os.Stdout.Write([]byte{'\n'})
-				check(err2)
+				probing.Add(1)
+				go func(entry *tableEntry, result mysqlscanner.MySQlInformation, consumed []byte) {
+					defer probing.Done()
+					conn := entry.wait()
+					if conn == nil {
+						result.Errormessage = errProbesSkipped
+						writeResult(result)
+						return
+					}
+					probeSlots <- struct{}{}
+					defer func() { <-probeSlots }()
+					defer conn.Close()
+					writeResult(prober.Run(conn, result, consumed))
+				}(entry, ipStr, result.Payload)
+			} else if ipStr.Issql == true {
+				connections.remove(resultKey(result))
+				writeResult(ipStr)
+			} else {
+				// The server is not speaking any passive module's protocol
+				connections.remove(resultKey(result))
 			}
 
-		case <-time.After(time.Duration(config.Cooldown) * 1000 * time.Millisecond):
+		case <-sendDone:
+			log.Info("Finished Sending")
+			sending = false
+			sendDone = nil
+
+		case <-cooldown:
 			// Wait cooldown seconds after the last MySQL packet is recieved
 			loop = false
 		}
 	}
 
-	// Close Any Outstanding Connections
+	// Wait for Active Probes and Close Any Outstanding Connections
+	probing.Wait()
 	log.Info("Closing Connections")
-	for _, conn := range connections {
-		conn.Close()
-	}
+	connections.closeAll()
+	log.Infof("Dropped %d Packets Not Matching a Probe", probes.Dropped())
 
 }
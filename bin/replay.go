@@ -0,0 +1,51 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bin
+
+import (
+	"mysqlscanner"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replayMain re-parses an archived capture, writing the same records a scan
+// would have. Active probes need a live connection and are not run.
+func replayMain(config mysqlscanner.Config, options mysqlscanner.ReplayOptions) {
+	validIP4, validIP6 := mysqlscanner.ValidateReplayConfig(config, options)
+
+	results := make(chan mysqlscanner.Result, 100000)
+	replayErr := make(chan error, 1)
+	go func() {
+		replayErr <- mysqlscanner.ReplayPCAP(config, options.PCAP, results, validIP4, validIP6)
+	}()
+
+	log.Infof("Replaying %s", options.PCAP)
+	for result := range results {
+		ipStr, isMySQL := result.Record.(mysqlscanner.MySQlInformation)
+		ipStr.IPAddress = result.IPAddress
+		ipStr.DstPort = result.DstPort
+		if result.Errormessage != "" {
+			writeError(result.IPAddress, result.DstPort, resultModule(result), result.Errormessage)
+		} else if result.Record != nil && !isMySQL {
+			writeJSON(mysqlscanner.NewEnvelope(result.IPAddress, result.DstPort, result.Module, result.Record))
+		} else if ipStr.Issql == true {
+			writeResult(ipStr)
+		}
+	}
+	check(<-replayErr)
+	log.Info("Finished Replaying")
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bin
+
+import (
+	"bufio"
+	"io"
+	"mysqlscanner"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// target is a single host/port pair read from the input, ready to be dialed.
+type target struct {
+	address      string
+	port         string
+	network      string
+	localAddress string
+	module       mysqlscanner.Module
+}
+
+// key returns the string used to index the target in the connection table.
+// It matches the format the receive loop builds from captured packets.
+func (t target) key() string {
+	return t.address + ":" + t.port
+}
+
+// ip returns the target address without the brackets used for IPv6 dialing.
+func (t target) ip() string {
+	return strings.Trim(t.address, "[]")
+}
+
+// connectionTable holds the open connections shared between the senders and
+// the receive loop, and keeps the probe table used to validate captured
+// packets in step with them. A target is reserved before it is dialed, so that
+// a duplicate target is reported instead of racing the first for the same
+// connection, and its entry is deleted once it has been recorded.
+type connectionTable struct {
+	mu     sync.Mutex
+	conns  map[string]*tableEntry
+	probes *mysqlscanner.ProbeTable
+}
+
+// tableEntry is the reservation for one target. conn is set when the dial
+// returns, which closes attached, and stays nil for raw mode probes, which
+// have no socket, and failed dials. An entry taken for active probes before
+// the dial returned is handed the connection once it is attached.
+type tableEntry struct {
+	conn     net.Conn
+	attached chan struct{}
+	taken    bool
+}
+
+// wait returns the connection once the dial has returned, or nil if it
+// failed.
+func (e *tableEntry) wait() net.Conn {
+	<-e.attached
+	return e.conn
+}
+
+// errDuplicateTarget is recorded for a target that is already being probed.
+const errDuplicateTarget = "duplicate target"
+
+// errProbesSkipped is recorded for a greeting whose connection could not be
+// used for the active probes.
+const errProbesSkipped = "active probes skipped: no open connection"
+
+func newConnectionTable(probes *mysqlscanner.ProbeTable) *connectionTable {
+	return &connectionTable{conns: make(map[string]*tableEntry), probes: probes}
+}
+
+// reserve adds an entry for a target about to be probed. It returns nil if the
+// target is already in the table.
+func (c *connectionTable) reserve(key string) *tableEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.conns[key]; ok {
+		return nil
+	}
+	entry := &tableEntry{attached: make(chan struct{})}
+	c.conns[key] = entry
+	return entry
+}
+
+// add attaches a newly dialed connection, or nil for a raw mode probe, to its
+// reservation. If the response for this target was already received and
+// recorded before the dial returned, the connection is closed immediately.
+func (c *connectionTable) add(key string, entry *tableEntry, conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.conn = conn
+	close(entry.attached)
+	if c.conns[key] != entry && !entry.taken && conn != nil {
+		conn.Close()
+		entry.conn = nil
+	}
+}
+
+// cancel ends the reservation for a target whose probe could not be sent. It
+// reports whether the target still needs a record, as one taken for active
+// probes is recorded by the receive loop.
+func (c *connectionTable) cancel(key string, entry *tableEntry) bool {
+	c.probes.Remove(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(entry.attached)
+	if c.conns[key] != entry {
+		return false
+	}
+	delete(c.conns, key)
+	return true
+}
+
+// remove closes the connection for a target that has been recorded. Further
+// packets for the target no longer match a probe.
+func (c *connectionTable) remove(key string) {
+	c.probes.Remove(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.conns[key]; ok {
+		if entry.conn != nil {
+			entry.conn.Close()
+		}
+		delete(c.conns, key)
+	}
+}
+
+// take removes the entry for a target that has been recorded without closing
+// its connection, so that it can be used for active probes. The connection
+// may still be dialing, and is returned by the entry's wait. It returns nil if
+// the target is not in the table.
+func (c *connectionTable) take(key string) *tableEntry {
+	c.probes.Remove(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.conns[key]
+	if !ok {
+		return nil
+	}
+	entry.taken = true
+	delete(c.conns, key)
+	return entry
+}
+
+func (c *connectionTable) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+func (c *connectionTable) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.conns {
+		if entry.conn != nil {
+			entry.conn.Close()
+		}
+		delete(c.conns, key)
+	}
+}
+
+// readTargets parses input lines from reader and queues them for the senders.
+// With config.Randomize the whole input is read before any target is queued,
+// so that targets from every line can be mixed. The targets channel is closed
+// once the input is exhausted.
+func readTargets(config mysqlscanner.Config, reader io.Reader, validIP4 bool, validIP6 bool, targets chan<- target) {
+	inputBuffer := bufio.NewReader(reader)
+	defer close(targets)
+	set := mysqlscanner.NewTargetSet(config.Randomize)
+	for {
+		line, err := inputBuffer.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+		} else if err != nil {
+			break
+		}
+
+		targetLine, err := mysqlscanner.ParseTargetLine(line, config.Randomize)
+		if err != nil {
+			log.Errorf("Not a Valid IP/Port pair: %s: %s", strings.TrimSpace(line), err)
+			continue
+		}
+		if (targetLine.IPv4() && !validIP4) || (!targetLine.IPv4() && !validIP6) {
+			log.Error("Correct Interface not specified.")
+			continue
+		}
+		set.Add(targetLine)
+		if !config.Randomize {
+			queueTargets(config, set, targets)
+		}
+	}
+	queueTargets(config, set, targets)
+}
+
+// queueTargets sends every target left in set to the senders.
+func queueTargets(config mysqlscanner.Config, set *mysqlscanner.TargetSet, targets chan<- target) {
+	for {
+		targetLine, ipaddress, port, ok := set.Next()
+		if !ok {
+			return
+		}
+		ipaddressString, networkString, inputLocalAddress := mysqlscanner.NetString(config, ipaddress)
+		module := mysqlscanner.ParseModule(targetLine.Module, port)
+		targets <- target{address: ipaddressString, port: port, network: networkString, localAddress: inputLocalAddress, module: module}
+	}
+}
+
+// probeConnection dials a target whose module is not parsed from captures and
+// runs the module's probe on the socket. These targets are dialed through the
+// kernel in raw mode too.
+func probeConnection(config mysqlscanner.Config, t target) {
+	conn, err := connectTCP(t.key(), config.Timeout, t.network, t.localAddress)
+	if err != nil {
+		writeError(t.ip(), t.port, t.module.Name(), err.Error())
+		return
+	}
+	defer conn.Close()
+	record := t.module.Probe(conn, config)
+	writeJSON(mysqlscanner.NewEnvelope(t.ip(), t.port, t.module.Name(), record))
+}
+
+// sendTargets dials targets with config.Senders concurrent workers. Successful
+// connections are added to the table; failed ones are written out as
+// TCPErrorStruct records under the target's module. In raw mode a SYN is
+// written through sender instead and the handshake is completed by the
+// receive loop. In socket receive mode the handshake is read from each
+// connection and sent to results. A target that is still being probed when it
+// appears again is recorded as a duplicate rather than dialed twice. It
+// returns once every target has been attempted.
+func sendTargets(config mysqlscanner.Config, targets <-chan target, connections *connectionTable, sender *mysqlscanner.RawSender, results chan<- mysqlscanner.Result) {
+	var wg sync.WaitGroup
+	for i := 0; i < config.Senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range targets {
+				if t.module.BPFFragment() == "" {
+					probeConnection(config, t)
+					continue
+				}
+				entry := connections.reserve(t.key())
+				if entry == nil {
+					writeError(t.ip(), t.port, t.module.Name(), errDuplicateTarget)
+					continue
+				}
+				if sender != nil {
+					if err := sender.SendSYN(t.ip(), t.port); err != nil {
+						if connections.cancel(t.key(), entry) {
+							writeError(t.ip(), t.port, t.module.Name(), err.Error())
+						}
+						continue
+					}
+					connections.add(t.key(), entry, nil)
+					continue
+				}
+				if config.Recv == "socket" {
+					conn, err := connectTCP(t.key(), config.Timeout, t.network, t.localAddress)
+					if err != nil {
+						if connections.cancel(t.key(), entry) {
+							writeError(t.ip(), t.port, t.module.Name(), err.Error())
+						}
+						continue
+					}
+					connections.add(t.key(), entry, conn)
+					result := mysqlscanner.ReadHandshake(conn, time.Duration(config.Timeout)*time.Second)
+					if result.Module == "" {
+						result.Module = t.module.Name()
+					}
+					results <- result
+					continue
+				}
+
+				// The local port is not known until the dial returns, by which
+				// time the greeting may already have been captured.
+				connections.probes.Add(t.key(), 0)
+				conn, err := connectTCP(t.key(), config.Timeout, t.network, t.localAddress)
+				if err != nil {
+					if connections.cancel(t.key(), entry) {
+						writeError(t.ip(), t.port, t.module.Name(), err.Error())
+					}
+					continue
+				}
+				if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+					connections.probes.SetLocalPort(t.key(), uint16(localAddr.Port))
+				}
+				connections.add(t.key(), entry, conn)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package bin
+
+import (
+	"mysqlscanner"
+	"net"
+	"testing"
+)
+
+func TestConnectionTable(t *testing.T) {
+	connections := newConnectionTable(mysqlscanner.NewProbeTable())
+	const key = "192.0.2.1:3306"
+
+	entry := connections.reserve(key)
+	if entry == nil {
+		t.Fatal("first reservation refused")
+	}
+	if connections.reserve(key) != nil {
+		t.Error("duplicate target reserved while in flight")
+	}
+
+	// The greeting is recorded before the dial returns
+	connections.remove(key)
+	client, server := net.Pipe()
+	defer server.Close()
+	connections.add(key, entry, client)
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Error("connection added after its target was recorded was not closed")
+	}
+	if n := connections.len(); n != 0 {
+		t.Errorf("table holds %d entries after the target was recorded, want 0", n)
+	}
+
+	// The greeting is taken for active probes before the dial returns
+	entry = connections.reserve(key)
+	if entry == nil {
+		t.Fatal("reservation refused after the target was recorded")
+	}
+	taken := connections.take(key)
+	if taken != entry {
+		t.Fatal("reserved target not taken")
+	}
+	client, server = net.Pipe()
+	defer server.Close()
+	connections.add(key, entry, client)
+	if conn := taken.wait(); conn != client {
+		t.Errorf("taken entry returned %v, want the dialed connection", conn)
+	}
+	go server.Read(make([]byte, 1))
+	if _, err := client.Write([]byte{0}); err != nil {
+		t.Errorf("connection handed to active probes was closed: %v", err)
+	}
+	client.Close()
+
+	// The dial fails after the greeting was taken
+	entry = connections.reserve(key)
+	connections.take(key)
+	if connections.cancel(key, entry) {
+		t.Error("failed dial of a taken target needs a second record")
+	}
+	if conn := entry.wait(); conn != nil {
+		t.Errorf("failed dial returned %v", conn)
+	}
+
+	// The dial fails before any greeting
+	entry = connections.reserve(key)
+	if !connections.cancel(key, entry) {
+		t.Error("failed dial not recorded")
+	}
+	if n := connections.len(); n != 0 {
+		t.Errorf("table holds %d entries after a failed dial, want 0", n)
+	}
+}
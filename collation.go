@@ -0,0 +1,165 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+// Collation is the server's default collation as sent in the handshake. The
+// handshake only carries the low byte of the collation ID, so MySQL 8.0
+// servers defaulting to a UCA 9.0.0 collation report 255.
+type Collation struct {
+	ID        uint8
+	Charset   string
+	Collation string
+}
+
+// collations maps collation IDs to their charset and collation names, as
+// listed by SHOW COLLATION on MySQL and MariaDB. The utf8 charset is named
+// utf8mb3, as on MySQL 8.0.30+ and MariaDB 10.6+. MariaDB names the Croatian
+// collations at IDs 122, 149, 181, 213 and 245 *_croatian_mysql561_ci.
+var collations = map[uint8]Collation{
+	1:   {1, "big5", "big5_chinese_ci"},
+	2:   {2, "latin2", "latin2_czech_cs"},
+	3:   {3, "dec8", "dec8_swedish_ci"},
+	4:   {4, "cp850", "cp850_general_ci"},
+	5:   {5, "latin1", "latin1_german1_ci"},
+	6:   {6, "hp8", "hp8_english_ci"},
+	7:   {7, "koi8r", "koi8r_general_ci"},
+	8:   {8, "latin1", "latin1_swedish_ci"},
+	9:   {9, "latin2", "latin2_general_ci"},
+	10:  {10, "swe7", "swe7_swedish_ci"},
+	11:  {11, "ascii", "ascii_general_ci"},
+	12:  {12, "ujis", "ujis_japanese_ci"},
+	13:  {13, "sjis", "sjis_japanese_ci"},
+	14:  {14, "cp1251", "cp1251_bulgarian_ci"},
+	15:  {15, "latin1", "latin1_danish_ci"},
+	16:  {16, "hebrew", "hebrew_general_ci"},
+	18:  {18, "tis620", "tis620_thai_ci"},
+	19:  {19, "euckr", "euckr_korean_ci"},
+	20:  {20, "latin7", "latin7_estonian_cs"},
+	21:  {21, "latin2", "latin2_hungarian_ci"},
+	22:  {22, "koi8u", "koi8u_general_ci"},
+	23:  {23, "cp1251", "cp1251_ukrainian_ci"},
+	24:  {24, "gb2312", "gb2312_chinese_ci"},
+	25:  {25, "greek", "greek_general_ci"},
+	26:  {26, "cp1250", "cp1250_general_ci"},
+	27:  {27, "latin2", "latin2_croatian_ci"},
+	28:  {28, "gbk", "gbk_chinese_ci"},
+	29:  {29, "cp1257", "cp1257_lithuanian_ci"},
+	30:  {30, "latin5", "latin5_turkish_ci"},
+	31:  {31, "latin1", "latin1_german2_ci"},
+	32:  {32, "armscii8", "armscii8_general_ci"},
+	33:  {33, "utf8mb3", "utf8mb3_general_ci"},
+	34:  {34, "cp1250", "cp1250_czech_cs"},
+	35:  {35, "ucs2", "ucs2_general_ci"},
+	36:  {36, "cp866", "cp866_general_ci"},
+	37:  {37, "keybcs2", "keybcs2_general_ci"},
+	38:  {38, "macce", "macce_general_ci"},
+	39:  {39, "macroman", "macroman_general_ci"},
+	40:  {40, "cp852", "cp852_general_ci"},
+	41:  {41, "latin7", "latin7_general_ci"},
+	42:  {42, "latin7", "latin7_general_cs"},
+	43:  {43, "macce", "macce_bin"},
+	44:  {44, "cp1250", "cp1250_croatian_ci"},
+	45:  {45, "utf8mb4", "utf8mb4_general_ci"},
+	46:  {46, "utf8mb4", "utf8mb4_bin"},
+	47:  {47, "latin1", "latin1_bin"},
+	48:  {48, "latin1", "latin1_general_ci"},
+	49:  {49, "latin1", "latin1_general_cs"},
+	50:  {50, "cp1251", "cp1251_bin"},
+	51:  {51, "cp1251", "cp1251_general_ci"},
+	52:  {52, "cp1251", "cp1251_general_cs"},
+	53:  {53, "macroman", "macroman_bin"},
+	54:  {54, "utf16", "utf16_general_ci"},
+	55:  {55, "utf16", "utf16_bin"},
+	56:  {56, "utf16le", "utf16le_general_ci"},
+	57:  {57, "cp1256", "cp1256_general_ci"},
+	58:  {58, "cp1257", "cp1257_bin"},
+	59:  {59, "cp1257", "cp1257_general_ci"},
+	60:  {60, "utf32", "utf32_general_ci"},
+	61:  {61, "utf32", "utf32_bin"},
+	62:  {62, "utf16le", "utf16le_bin"},
+	63:  {63, "binary", "binary"},
+	64:  {64, "armscii8", "armscii8_bin"},
+	65:  {65, "ascii", "ascii_bin"},
+	66:  {66, "cp1250", "cp1250_bin"},
+	67:  {67, "cp1256", "cp1256_bin"},
+	68:  {68, "cp866", "cp866_bin"},
+	69:  {69, "dec8", "dec8_bin"},
+	70:  {70, "greek", "greek_bin"},
+	71:  {71, "hebrew", "hebrew_bin"},
+	72:  {72, "hp8", "hp8_bin"},
+	73:  {73, "keybcs2", "keybcs2_bin"},
+	74:  {74, "koi8r", "koi8r_bin"},
+	75:  {75, "koi8u", "koi8u_bin"},
+	76:  {76, "utf8mb3", "utf8mb3_tolower_ci"},
+	77:  {77, "latin2", "latin2_bin"},
+	78:  {78, "latin5", "latin5_bin"},
+	79:  {79, "latin7", "latin7_bin"},
+	80:  {80, "cp850", "cp850_bin"},
+	81:  {81, "cp852", "cp852_bin"},
+	82:  {82, "swe7", "swe7_bin"},
+	83:  {83, "utf8mb3", "utf8mb3_bin"},
+	84:  {84, "big5", "big5_bin"},
+	85:  {85, "euckr", "euckr_bin"},
+	86:  {86, "gb2312", "gb2312_bin"},
+	87:  {87, "gbk", "gbk_bin"},
+	88:  {88, "sjis", "sjis_bin"},
+	89:  {89, "tis620", "tis620_bin"},
+	90:  {90, "ucs2", "ucs2_bin"},
+	91:  {91, "ujis", "ujis_bin"},
+	92:  {92, "geostd8", "geostd8_general_ci"},
+	93:  {93, "geostd8", "geostd8_bin"},
+	94:  {94, "latin1", "latin1_spanish_ci"},
+	95:  {95, "cp932", "cp932_japanese_ci"},
+	96:  {96, "cp932", "cp932_bin"},
+	97:  {97, "eucjpms", "eucjpms_japanese_ci"},
+	98:  {98, "eucjpms", "eucjpms_bin"},
+	99:  {99, "cp1250", "cp1250_polish_ci"},
+	159: {159, "ucs2", "ucs2_general_mysql500_ci"},
+	223: {223, "utf8mb3", "utf8mb3_general_mysql500_ci"},
+	248: {248, "gb18030", "gb18030_chinese_ci"},
+	249: {249, "gb18030", "gb18030_bin"},
+	250: {250, "gb18030", "gb18030_unicode_520_ci"},
+	255: {255, "utf8mb4", "utf8mb4_0900_ai_ci"},
+}
+
+// ucaCollations are the UCA 4.0.0 and 5.2.0 collations that each Unicode
+// charset defines, in ID order from the charset's first UCA collation.
+var ucaCollations = []string{
+	"unicode_ci", "icelandic_ci", "latvian_ci", "romanian_ci", "slovenian_ci", "polish_ci",
+	"estonian_ci", "spanish_ci", "swedish_ci", "turkish_ci", "czech_ci", "danish_ci",
+	"lithuanian_ci", "slovak_ci", "spanish2_ci", "roman_ci", "persian_ci", "esperanto_ci",
+	"hungarian_ci", "sinhala_ci", "german2_ci", "croatian_ci", "unicode_520_ci", "vietnamese_ci",
+}
+
+func init() {
+	ucaCharsets := []struct {
+		charset string
+		firstID uint8
+	}{
+		{"utf16", 101},
+		{"ucs2", 128},
+		{"utf32", 160},
+		{"utf8mb3", 192},
+		{"utf8mb4", 224},
+	}
+	for _, ucaCharset := range ucaCharsets {
+		for i, name := range ucaCollations {
+			id := ucaCharset.firstID + uint8(i)
+			collations[id] = Collation{id, ucaCharset.charset, ucaCharset.charset + "_" + name}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import "testing"
+
+func TestParseLanguage(t *testing.T) {
+	tests := []Collation{
+		{8, "latin1", "latin1_swedish_ci"},
+		{33, "utf8mb3", "utf8mb3_general_ci"},
+		{45, "utf8mb4", "utf8mb4_general_ci"},
+		{101, "utf16", "utf16_unicode_ci"},
+		{128, "ucs2", "ucs2_unicode_ci"},
+		{214, "utf8mb3", "utf8mb3_unicode_520_ci"},
+		{224, "utf8mb4", "utf8mb4_unicode_ci"},
+		{247, "utf8mb4", "utf8mb4_vietnamese_ci"},
+		{255, "utf8mb4", "utf8mb4_0900_ai_ci"},
+		{17, "", ""},
+	}
+	for _, want := range tests {
+		if got := parseLanguage([]byte{want.ID}); got != want {
+			t.Errorf("parseLanguage(%d) = %+v, want %+v", want.ID, got, want)
+		}
+	}
+}
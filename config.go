@@ -25,28 +25,118 @@ import (
 // Config is the high level framework options that will be parsed
 // from the command line
 type Config struct {
-	Timeout     int    `short:"t" long:"timeout" default:"10" description:"Timeout for TCP connection in seconds."`
-	Cooldown    int    `short:"c" long:"cooldown" default:"2" description:"Time to Wait after last MySQL packet is recieved to close remaining connections."`
-	SourceAddr4 string `short:"4" long:"source-address-ip4" default:"" description:"IPv6 Address of Interface"`
-	SourceAddr6 string `short:"6" long:"source-address-ip6" default:"" description:"IPv4 Address of Interface"`
-	Interface   string `short:"i" long:"interface" default:"" description:"Interface"`
+	Timeout         int      `short:"t" long:"timeout" default:"10" description:"Timeout for TCP connection in seconds."`
+	Cooldown        int      `short:"c" long:"cooldown" default:"2" description:"Time to Wait after last MySQL packet is recieved to close remaining connections."`
+	SourceAddr4     string   `short:"4" long:"source-address-ip4" default:"" description:"IPv6 Address of Interface"`
+	SourceAddr6     string   `short:"6" long:"source-address-ip6" default:"" description:"IPv4 Address of Interface"`
+	Interface       string   `short:"i" long:"interface" default:"" description:"Interface"`
+	Senders         int      `short:"s" long:"senders" default:"100" description:"Number of TCP connections to attempt concurrently."`
+	Randomize       bool     `long:"randomize" description:"Probe the addresses and ports of the input in a random order, rather than one network after another. The whole input is read before probing starts."`
+	Mode            string   `long:"mode" default:"dial" choice:"dial" choice:"raw" description:"Send TCP handshakes through the kernel (dial) or as crafted packets on the interface (raw)."`
+	Recv            string   `long:"recv" default:"pcap" choice:"pcap" choice:"socket" description:"Receive handshakes by capturing packets on the interface (pcap) or by reading each dialed socket (socket)."`
+	GatewayMAC      string   `long:"gateway-mac" default:"" description:"MAC Address of the Gateway (required for raw mode)"`
+	PCAPOut         string   `long:"pcap-out" default:"" description:"Write every captured packet accepted by the receiver to this pcapng file, commented with its target."`
+	TLS             bool     `long:"tls" description:"Upgrade connections to servers supporting SSL and record the TLS handshake (dial mode only)."`
+	TLSServerName   string   `long:"tls-server-name" default:"" description:"Server name to send in the TLS SNI extension."`
+	CheckAnonymous  bool     `long:"check-anonymous" description:"Attempt logins with an empty password as an anonymous user and as root, for authorized audits (dial mode only)."`
+	AuthFile        string   `long:"auth-file" default:"" description:"File of user:password pairs to attempt logging in with, for authorized audits (dial mode only)."`
+	PostgresStartup bool     `long:"postgres-startup" description:"Send a StartupMessage with a dummy user to PostgreSQL targets to record their authentication method."`
+	PublicKey       bool     `long:"public-key" description:"Request the RSA public key of servers using caching_sha2_password or sha256_password (dial mode only)."`
+	Queries         []string `long:"query" default:"SHOW VARIABLES LIKE 'have_ssl'" default:"SELECT @@require_secure_transport" default:"SELECT @@local_infile" default:"SELECT @@skip_name_resolve" description:"Read-only SELECT or SHOW statement to run after a successful login. May be repeated."`
 }
 
 var config Config
 
+// ReplayOptions are the options of the replay command, which re-parses an
+// archived capture instead of scanning.
+type ReplayOptions struct {
+	PCAP string `long:"pcap" required:"true" description:"Capture file (pcap or pcapng) to re-parse."`
+}
+
+var replayOptions ReplayOptions
+
 func ValidateConfig(config Config) (bool, bool) {
+	// Check Socket Mode
+	if config.Recv == "socket" && config.Mode == "raw" {
+		log.Fatal("Socket Receive Mode Requires Dial Mode")
+	}
+
+	// The kernel chooses the source address in socket mode when none is given
+	validIP4, validIP6 := validateSourceAddresses(config, config.Recv == "socket")
+
+	// Check Interface
+	if config.Interface == "" && config.Recv != "socket" {
+		log.Fatal("No Interface Provided")
+	}
+
+	// Check Raw Mode
+	if config.Mode == "raw" {
+		if config.GatewayMAC == "" {
+			log.Fatal("No Gateway MAC Address Provided for Raw Mode")
+		} else if _, err := net.ParseMAC(config.GatewayMAC); err != nil {
+			log.Fatalf("Not a Valid Gateway MAC Address: %s", config.GatewayMAC)
+		}
+	}
+
+	// Check Capture Output
+	if config.PCAPOut != "" && config.Recv == "socket" {
+		log.Warn("Capture Output Requires PCAP Receive Mode and Will Be Skipped")
+	}
+
+	// Check Active Probes
+	if config.TLS && config.Mode == "raw" {
+		log.Warn("TLS Probing Requires Dial Mode and Will Be Skipped")
+	}
+	if (config.AuthFile != "" || config.CheckAnonymous) && config.Mode == "raw" {
+		log.Warn("Credential Probing Requires Dial Mode and Will Be Skipped")
+	}
+	if config.PublicKey && config.Mode == "raw" {
+		log.Warn("Public Key Probing Requires Dial Mode and Will Be Skipped")
+	}
+
+	// Check Queries
+	for _, query := range config.Queries {
+		if err := ValidateQuery(query); err != nil {
+			log.Fatalf("Not a Valid Query: %s: %s", query, err)
+		}
+	}
+
+	// Check Senders
+	if config.Senders < 1 {
+		log.Fatalf("Number of Senders must be at least 1: %d", config.Senders)
+	}
+
+	return validIP4, validIP6
+}
+
+// ValidateReplayConfig checks the options of the replay command. The source
+// addresses are optional: without them, replies to any address in the
+// capture are parsed.
+func ValidateReplayConfig(config Config, options ReplayOptions) (bool, bool) {
+	if options.PCAP == "" {
+		log.Fatal("No Capture File Provided")
+	}
+	return validateSourceAddresses(config, true)
+}
+
+// validateSourceAddresses checks the IPv4 and IPv6 source addresses and
+// reports which were given. If optional, giving neither enables both.
+func validateSourceAddresses(config Config, optional bool) (bool, bool) {
 	validIP4 := false
 	validIP6 := false
+	if optional && config.SourceAddr4 == "" && config.SourceAddr6 == "" {
+		return true, true
+	}
 
 	// Check IPv4 Address
 	if config.SourceAddr4 != "" {
 		ipaddress := net.ParseIP(config.SourceAddr4)
 		if ipaddress == nil {
-			log.Fatal("Not a Valid IPv4 Address: %s", config.SourceAddr4)
+			log.Fatalf("Not a Valid IPv4 Address: %s", config.SourceAddr4)
 		} else if ipaddress.To4() != nil {
 			validIP4 = true
 		} else {
-			log.Fatal("Not a Valid IPv4 Address: %s", config.SourceAddr4)
+			log.Fatalf("Not a Valid IPv4 Address: %s", config.SourceAddr4)
 		}
 	} else {
 		log.Warn("No IPv4 Address Provided")
@@ -56,11 +146,11 @@ func ValidateConfig(config Config) (bool, bool) {
 	if config.SourceAddr6 != "" {
 		ipaddress := net.ParseIP(config.SourceAddr6)
 		if ipaddress == nil {
-			log.Fatal("Not a Valid IPv6 Address: %s", config.SourceAddr6)
+			log.Fatalf("Not a Valid IPv6 Address: %s", config.SourceAddr6)
 		} else if ipaddress.To4() == nil {
 			validIP6 = true
 		} else {
-			log.Fatal("Not a Valid IPv6 Address: %s", config.SourceAddr6)
+			log.Fatalf("Not a Valid IPv6 Address: %s", config.SourceAddr6)
 		}
 	} else {
 		log.Warn("No IPv6 Address Provided")
@@ -69,11 +159,5 @@ func ValidateConfig(config Config) (bool, bool) {
 	if validIP4 == false && validIP6 == false {
 		log.Fatal("No Valid Interface Address Provided")
 	}
-
-	// Check Interface
-	if config.Interface == "" {
-		log.Fatal("No Interface Provided")
-	}
-
 	return validIP4, validIP6
 }
@@ -0,0 +1,49 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+// ErrorClass groups the error codes a server may refuse a connection with
+// into the reasons that matter when triaging results.
+type ErrorClass string
+
+const (
+	ErrorClassHostBlocked        ErrorClass = "host_blocked"
+	ErrorClassHostNotAllowed     ErrorClass = "host_not_allowed"
+	ErrorClassTooManyConnections ErrorClass = "too_many_connections"
+	ErrorClassAccessDenied       ErrorClass = "access_denied"
+	ErrorClassBadHandshake       ErrorClass = "bad_handshake"
+	ErrorClassShutdown           ErrorClass = "shutdown"
+	ErrorClassOther              ErrorClass = "other"
+)
+
+var errorClasses = map[uint16]ErrorClass{
+	1040: ErrorClassTooManyConnections, // ER_CON_COUNT_ERROR
+	1043: ErrorClassBadHandshake,       // ER_HANDSHAKE_ERROR
+	1044: ErrorClassAccessDenied,       // ER_DBACCESS_DENIED_ERROR
+	1045: ErrorClassAccessDenied,       // ER_ACCESS_DENIED_ERROR
+	1053: ErrorClassShutdown,           // ER_SERVER_SHUTDOWN
+	1129: ErrorClassHostBlocked,        // ER_HOST_IS_BLOCKED
+	1130: ErrorClassHostNotAllowed,     // ER_HOST_NOT_PRIVILEGED
+	1203: ErrorClassTooManyConnections, // ER_TOO_MANY_USER_CONNECTIONS
+}
+
+func classifyError(errorCode uint16) ErrorClass {
+	if errorClass, ok := errorClasses[errorCode]; ok {
+		return errorClass
+	}
+	return ErrorClassOther
+}
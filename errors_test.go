@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import "testing"
+
+func TestParseMySQLError(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    MySQlInformation
+	}{
+		{
+			name:    "access denied",
+			payload: "\xff\x15\x04#28000Access denied for user 'root'@'192.0.2.9'",
+			want: MySQlInformation{Issql: true, Sqlerror: true, Errorcode: 1045, SQLState: "28000",
+				ErrorClass: ErrorClassAccessDenied, Errormessage: "Access denied for user 'root'@'192.0.2.9'"},
+		},
+		{
+			name:    "host not allowed",
+			payload: "\xff\x6a\x04Host '192.0.2.9' is not allowed to connect to this MySQL server",
+			want: MySQlInformation{Issql: true, Sqlerror: true, Errorcode: 1130,
+				ErrorClass: ErrorClassHostNotAllowed, Errormessage: "Host '192.0.2.9' is not allowed to connect to this MySQL server"},
+		},
+		{
+			name:    "unclassified",
+			payload: "\xff\xe8\x03#HY000hashchk",
+			want: MySQlInformation{Issql: true, Sqlerror: true, Errorcode: 1000, SQLState: "HY000",
+				ErrorClass: ErrorClassOther, Errormessage: "hashchk"},
+		},
+		{
+			name:    "marker without a full SQLSTATE",
+			payload: "\xff\x15\x04#280",
+			want: MySQlInformation{Issql: true, Sqlerror: true, Errorcode: 1045,
+				ErrorClass: ErrorClassAccessDenied, Errormessage: "#280"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := append([]byte{byte(len(test.payload)), 0, 0, 0}, test.payload...)
+			got, err := ParseMySQLError(packet)
+			if err != nil {
+				t.Fatalf("ParseMySQLError: %v", err)
+			}
+			if got.Errorcode != test.want.Errorcode || got.SQLState != test.want.SQLState ||
+				got.ErrorClass != test.want.ErrorClass || got.Errormessage != test.want.Errormessage ||
+				!got.Issql || !got.Sqlerror {
+				t.Errorf("ParseMySQLError() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := ParseMySQLError([]byte{3, 0, 0, 0, 0xff, 0x15}); err == nil {
+		t.Error("ParseMySQLError accepted a truncated error code")
+	}
+}
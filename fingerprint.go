@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+type ParsedVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// Fingerprint is the best guess at the server implementation behind a
+// handshake. Confidence ranges from 0 to 1.
+type Fingerprint struct {
+	Vendor        string
+	Product       string
+	ParsedVersion ParsedVersion
+	Confidence    float64
+}
+
+// fingerprintRule classifies a handshake by its version string and, where
+// the version string alone is ambiguous, its other fields. The first group of
+// pattern that matched, if any, holds the product's own version.
+type fingerprintRule struct {
+	vendor     string
+	product    string
+	pattern    *regexp.Regexp
+	check      func(MySQlInformation) bool
+	confidence float64
+}
+
+// fingerprintRules are tried in order, from the most specific version string
+// markers down to defaults that are only suggested by the version number.
+var fingerprintRules = []fingerprintRule{
+	{"PingCAP", "TiDB", regexp.MustCompile(`(?i)-TiDB-v?(\d+\.\d+\.\d+)`), nil, 0.95},
+	{"PlanetScale", "Vitess", regexp.MustCompile(`(?i)-vitess(?:-(\d+\.\d+\.\d+))?`), nil, 0.95},
+	{"Amazon", "Aurora MySQL", regexp.MustCompile(`mysql_aurora\.(\d+\.\d+\.\d+)`), nil, 0.95},
+	{"ClickHouse", "ClickHouse", regexp.MustCompile(`(?i)clickhouse`), nil, 0.9},
+	{"SingleStore", "SingleStore", regexp.MustCompile(`(?i)memsql|singlestore`), nil, 0.9},
+	{"Manticore", "Manticore Search", regexp.MustCompile(`^(\d+\.\d+\.\d+) [0-9a-f]+@\d{6}`), nil, 0.85},
+	{"Sphinx", "Sphinx", regexp.MustCompile(`^(\d+\.\d+\.\d+)(?:-id64)?-(?:release|beta|dev)`), nil, 0.85},
+	{"Sphinx", "Sphinx", regexp.MustCompile(`^(\d+\.\d+\.\d+) \(commit [0-9a-f]+\)`), nil, 0.85},
+	{"MariaDB", "Galera Cluster", regexp.MustCompile(`(?i)(\d+\.\d+\.\d+)-MariaDB.*wsrep`), nil, 0.9},
+	{"Codership", "Galera Cluster", regexp.MustCompile(`(?i)^(\d+\.\d+\.\d+).*wsrep`), nil, 0.85},
+	{"MariaDB", "MariaDB", regexp.MustCompile(`(?i)(?:^5\.5\.5-)?(\d+\.\d+\.\d+)-MariaDB`), nil, 0.95},
+	{"Percona", "Percona Server", regexp.MustCompile(`(?i)^(\d+\.\d+\.\d+)-\d+(?:\.\d+)?(?:-log)?$|percona`), nil, 0.7},
+	{"Apache", "Doris", regexp.MustCompile(`^5\.7\.99$`), nil, 0.5},
+	{"Doris/StarRocks", "Doris/StarRocks", regexp.MustCompile(`^5\.1\.0$`), nil, 0.5},
+	{"ProxySQL", "ProxySQL", regexp.MustCompile(`^5\.5\.30$`), func(mysqlinformation MySQlInformation) bool {
+		return mysqlinformation.AuthenticationPlugin == "mysql_native_password"
+	}, 0.5},
+	{"Amazon", "Aurora MySQL", regexp.MustCompile(`^5\.6\.10a?$`), nil, 0.5},
+	{"SingleStore", "SingleStore", regexp.MustCompile(`^5\.5\.58$`), nil, 0.4},
+	// MariaDB 10.2+ clears CLIENT_MYSQL (CLIENT_LONG_PASSWORD) to signal its
+	// extended capabilities, even when the version string is customised.
+	{"MariaDB", "MariaDB", regexp.MustCompile(`^(\d+\.\d+\.\d+)`), func(mysqlinformation MySQlInformation) bool {
+		return mysqlinformation.Version == 10 && !mysqlinformation.ServerCapabilities.LONGPASSWORD && mysqlinformation.ServerCapabilities.SPEAKS41NEW
+	}, 0.7},
+	{"Oracle", "MySQL", regexp.MustCompile(`^(\d+\.\d+(?:\.\d+)?)`), nil, 0.6},
+}
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+func parseVersion(version string) ParsedVersion {
+	parsedVersion := ParsedVersion{}
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return parsedVersion
+	}
+	parsedVersion.Major, _ = strconv.Atoi(match[1])
+	parsedVersion.Minor, _ = strconv.Atoi(match[2])
+	parsedVersion.Patch, _ = strconv.Atoi(match[3])
+	return parsedVersion
+}
+
+// FingerprintHandshake classifies the server behind a handshake by its
+// version string, capability flags, authentication plugin, salt and status
+// flags.
+func FingerprintHandshake(mysqlinformation MySQlInformation) Fingerprint {
+	fingerprint := Fingerprint{Vendor: "Unknown", Product: "Unknown", ParsedVersion: parseVersion(mysqlinformation.VersionString)}
+	for _, rule := range fingerprintRules {
+		match := rule.pattern.FindStringSubmatch(mysqlinformation.VersionString)
+		if match == nil || (rule.check != nil && !rule.check(mysqlinformation)) {
+			continue
+		}
+		fingerprint.Vendor = rule.vendor
+		fingerprint.Product = rule.product
+		fingerprint.Confidence = rule.confidence
+		if len(match) > 1 && match[1] != "" {
+			fingerprint.ParsedVersion = parseVersion(match[1])
+		}
+		break
+	}
+
+	// caching_sha2_password is the default plugin from MySQL 8.0
+	if fingerprint.Product == "MySQL" && fingerprint.ParsedVersion.Major >= 8 && mysqlinformation.AuthenticationPlugin == "caching_sha2_password" {
+		fingerprint.Confidence += 0.2
+	}
+
+	// Handshakes that no real server would send suggest a honeypot
+	anomalies := handshakeAnomalies(mysqlinformation)
+	if anomalies >= 2 {
+		fingerprint.Vendor = "Unknown"
+		fingerprint.Product = "Honeypot"
+		fingerprint.Confidence = 0.5 + 0.1*float64(anomalies)
+		if fingerprint.Confidence > 0.9 {
+			fingerprint.Confidence = 0.9
+		}
+	} else if anomalies == 1 {
+		fingerprint.Confidence -= 0.2
+	}
+	fingerprint.Confidence = math.Round(math.Max(fingerprint.Confidence, 0)*100) / 100
+	return fingerprint
+}
+
+// handshakeAnomalies counts the properties of a Handshake v10 that MySQL
+// compatible servers do not produce: a zero thread ID, salts that are not
+// random 7-bit bytes, an advertised auth plugin that is missing, and an
+// empty status.
+func handshakeAnomalies(mysqlinformation MySQlInformation) int {
+	if mysqlinformation.Version != 10 {
+		return 0
+	}
+
+	anomalies := 0
+	if mysqlinformation.ThreadID == 0 {
+		anomalies++
+	}
+
+	salt := append(append([]byte(nil), mysqlinformation.Salt1...), mysqlinformation.Salt2...)
+	if len(salt) > 0 && bytes.Count(salt, salt[:1]) == len(salt) {
+		anomalies++
+	} else {
+		for i := 0; i < len(salt); i++ {
+			if salt[i] == 0 || salt[i] > 0x7f {
+				anomalies++
+				break
+			}
+		}
+	}
+
+	if mysqlinformation.ServerCapabilities.PLUGINAUTH && mysqlinformation.AuthenticationPlugin == "" {
+		anomalies++
+	}
+	if mysqlinformation.ServerStatus == (ServerStatus{}) {
+		anomalies++
+	}
+	return anomalies
+}
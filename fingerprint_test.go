@@ -0,0 +1,72 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import "testing"
+
+func TestFingerprintHandshake(t *testing.T) {
+	tests := []struct {
+		version    string
+		plugin     string
+		modify     func(*MySQlInformation)
+		vendor     string
+		product    string
+		parsed     ParsedVersion
+		confidence float64
+	}{
+		{"8.0.36", "caching_sha2_password", nil, "Oracle", "MySQL", ParsedVersion{8, 0, 36}, 0.8},
+		{"5.7.44-log", "mysql_native_password", nil, "Oracle", "MySQL", ParsedVersion{5, 7, 44}, 0.6},
+		{"5.7.44-48", "mysql_native_password", nil, "Percona", "Percona Server", ParsedVersion{5, 7, 44}, 0.7},
+		{"5.5.5-10.11.6-MariaDB", "mysql_native_password", nil, "MariaDB", "MariaDB", ParsedVersion{10, 11, 6}, 0.95},
+		{"5.5.5-10.6.16-MariaDB-log-wsrep", "mysql_native_password", nil, "MariaDB", "Galera Cluster", ParsedVersion{10, 6, 16}, 0.9},
+		{"8.0.11-TiDB-v7.5.0", "mysql_native_password", nil, "PingCAP", "TiDB", ParsedVersion{7, 5, 0}, 0.95},
+		{"5.7.99", "mysql_native_password", nil, "Apache", "Doris", ParsedVersion{5, 7, 99}, 0.5},
+		{"5.1.0", "mysql_native_password", nil, "Doris/StarRocks", "Doris/StarRocks", ParsedVersion{5, 1, 0}, 0.5},
+		{"5.5.30", "mysql_native_password", nil, "ProxySQL", "ProxySQL", ParsedVersion{5, 5, 30}, 0.5},
+		{"5.5.30", "caching_sha2_password", nil, "Oracle", "MySQL", ParsedVersion{5, 5, 30}, 0.6},
+		{"10.4.32-custom", "mysql_native_password", func(mysqlinformation *MySQlInformation) {
+			mysqlinformation.ServerCapabilities.LONGPASSWORD = false
+		}, "MariaDB", "MariaDB", ParsedVersion{10, 4, 32}, 0.7},
+		{"8.0.36", "caching_sha2_password", func(mysqlinformation *MySQlInformation) {
+			mysqlinformation.ThreadID = 0
+		}, "Oracle", "MySQL", ParsedVersion{8, 0, 36}, 0.6},
+		{"8.0.36", "caching_sha2_password", func(mysqlinformation *MySQlInformation) {
+			mysqlinformation.ThreadID = 0
+			mysqlinformation.ServerStatus = ServerStatus{}
+		}, "Unknown", "Honeypot", ParsedVersion{8, 0, 36}, 0.7},
+		{"5.7.44", "mysql_native_password", func(mysqlinformation *MySQlInformation) {
+			mysqlinformation.Salt1 = HexBytes("aaaaaaaa")
+			mysqlinformation.Salt2 = HexBytes("aaaaaaaaaaaa")
+			mysqlinformation.AuthenticationPlugin = ""
+			mysqlinformation.ServerStatus = ServerStatus{}
+		}, "Unknown", "Honeypot", ParsedVersion{5, 7, 44}, 0.8},
+	}
+	for _, test := range tests {
+		mysqlinformation, err := ParseMySQL(testGreeting(test.plugin, 0))
+		if err != nil {
+			t.Fatalf("ParseMySQL: %v", err)
+		}
+		mysqlinformation.VersionString = test.version
+		if test.modify != nil {
+			test.modify(&mysqlinformation)
+		}
+		got := FingerprintHandshake(mysqlinformation)
+		want := Fingerprint{test.vendor, test.product, test.parsed, test.confidence}
+		if got != want {
+			t.Errorf("FingerprintHandshake(%q, %s) = %+v, want %+v", test.version, test.plugin, got, want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// Module probes targets for one protocol. Modules for protocols where the
+// server speaks first are parsed from the packets captured by the PCAP
+// listener. The rest are probed directly on the dialed connection, and have
+// no BPF fragment.
+type Module interface {
+	// Name keys the module's records in the output and selects the module
+	// in the input.
+	Name() string
+
+	// BPFFragment is a filter for the server packets the module parses from
+	// captures, or "" if the module is only probed on the connection.
+	BPFFragment() string
+
+	// Match reports whether payload, the start of a server's stream, is the
+	// module's protocol, and the length of the server's first response once
+	// enough of it has arrived to tell (0 until then).
+	Match(payload []byte) (int, bool)
+
+	// Parse decodes the server's first response into the module's record.
+	// Errors are recorded in the record rather than returned.
+	Parse(payload []byte) interface{}
+
+	// Probe runs the module's exchange on conn and returns its record.
+	Probe(conn net.Conn, config Config) interface{}
+}
+
+// defaultModule probes targets whose port has no module of its own.
+const defaultModule = "MySQL"
+
+var (
+	modules     []Module
+	modulePorts = make(map[int]Module)
+)
+
+// RegisterModule makes a module available to the scanner, as the default for
+// the given ports.
+func RegisterModule(module Module, ports ...int) {
+	modules = append(modules, module)
+	for _, port := range ports {
+		modulePorts[port] = module
+	}
+}
+
+// LookupModule returns the module with the given name, ignoring case.
+func LookupModule(name string) (Module, bool) {
+	for _, module := range modules {
+		if strings.EqualFold(module.Name(), name) {
+			return module, true
+		}
+	}
+	return nil, false
+}
+
+// ModuleForPort returns the module registered for port, or the default module.
+func ModuleForPort(port int) Module {
+	if module, ok := modulePorts[port]; ok {
+		return module
+	}
+	module, _ := LookupModule(defaultModule)
+	return module
+}
+
+// PassiveModules returns the modules that are parsed from captured packets,
+// in the order they were registered.
+func PassiveModules() []Module {
+	var passive []Module
+	for _, module := range modules {
+		if module.BPFFragment() != "" {
+			passive = append(passive, module)
+		}
+	}
+	return passive
+}
+
+// Result is the outcome of probing one target. Record is the module's
+// record, and Errormessage is set instead when no connection was made.
+// Payload holds the bytes already read from the connection when the result
+// was read from the socket rather than captured.
+type Result struct {
+	IPAddress    string
+	DstPort      string
+	Module       string
+	Record       interface{}
+	Errormessage string
+	Payload      []byte
+}
+
+// Envelope is the output record of one target. Each module's record is
+// written under the module's name, next to the target's address and port.
+type Envelope struct {
+	IPAddress string
+	DstPort   string
+	Records   map[string]interface{}
+}
+
+func NewEnvelope(ipaddress string, port string, module string, record interface{}) Envelope {
+	return Envelope{IPAddress: ipaddress, DstPort: port, Records: map[string]interface{}{module: record}}
+}
+
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	object := map[string]interface{}{"IPAddress": e.IPAddress, "DstPort": e.DstPort}
+	for module, record := range e.Records {
+		object[module] = record
+	}
+	return json.Marshal(object)
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TDS packet types and header length.
+const (
+	tdsPreLogin       = 0x12
+	tdsTabularResult  = 0x04
+	tdsHeaderLength   = 8
+	tdsStatusEOM      = 0x01
+	tdsPreLoginLength = 4096
+)
+
+// PRELOGIN option tokens.
+const (
+	tdsOptionVersion    = 0x00
+	tdsOptionEncryption = 0x01
+	tdsOptionInstOpt    = 0x02
+	tdsOptionThreadID   = 0x03
+	tdsOptionMARS       = 0x04
+	tdsOptionTerminator = 0xff
+)
+
+var tdsEncryption = map[uint8]string{
+	0x00: "ENCRYPT_OFF",
+	0x01: "ENCRYPT_ON",
+	0x02: "ENCRYPT_NOT_SUP",
+	0x03: "ENCRYPT_REQ",
+}
+
+// mssqlProducts names SQL Server releases by major version.
+var mssqlProducts = map[uint8]string{
+	8:  "SQL Server 2000",
+	9:  "SQL Server 2005",
+	10: "SQL Server 2008",
+	11: "SQL Server 2012",
+	12: "SQL Server 2014",
+	13: "SQL Server 2016",
+	14: "SQL Server 2017",
+	15: "SQL Server 2019",
+	16: "SQL Server 2022",
+}
+
+// MSSQLInformation records a Microsoft SQL Server's PRELOGIN response.
+type MSSQLInformation struct {
+	IPAddress    string
+	DstPort      string
+	Issql        bool
+	Version      string
+	Product      string
+	Encryption   string
+	Instance     string
+	ThreadID     uint32
+	MARS         bool
+	Errormessage string `json:",omitempty"`
+}
+
+func init() {
+	RegisterModule(mssqlModule{}, 1433)
+}
+
+// mssqlModule probes Microsoft SQL Server with a TDS PRELOGIN packet, which
+// the server waits for before sending anything.
+type mssqlModule struct{}
+
+func (mssqlModule) Name() string {
+	return "MSSQL"
+}
+
+func (mssqlModule) BPFFragment() string {
+	return ""
+}
+
+// Match checks for a TDS tabular result header and returns the packet length
+// it gives.
+func (mssqlModule) Match(payload []byte) (int, bool) {
+	if len(payload) < 4 {
+		return 0, true
+	}
+	length := int(binary.BigEndian.Uint16(payload[2:4]))
+	return length, payload[0] == tdsTabularResult && length >= tdsHeaderLength
+}
+
+// Parse decodes the PRELOGIN response packet, including its TDS header.
+func (mssqlModule) Parse(payload []byte) interface{} {
+	mssqlinformation := MSSQLInformation{}
+	if len(payload) < tdsHeaderLength || payload[0] != tdsTabularResult {
+		mssqlinformation.Errormessage = "not a TDS PRELOGIN response"
+		return mssqlinformation
+	}
+	length := int(binary.BigEndian.Uint16(payload[2:4]))
+	if length < tdsHeaderLength || length > len(payload) {
+		mssqlinformation.Errormessage = "truncated TDS packet"
+		return mssqlinformation
+	}
+	body := payload[tdsHeaderLength:length]
+
+	// Option Tokens
+	reader := payloadReader{payload: body}
+	for {
+		token, err := reader.readByte()
+		if err != nil {
+			mssqlinformation.Errormessage = err.Error()
+			return mssqlinformation
+		}
+		if token == tdsOptionTerminator {
+			break
+		}
+		header, err := reader.next(4)
+		if err != nil {
+			mssqlinformation.Errormessage = err.Error()
+			return mssqlinformation
+		}
+		offset := int(binary.BigEndian.Uint16(header[0:2]))
+		optionLength := int(binary.BigEndian.Uint16(header[2:4]))
+		if offset+optionLength > len(body) {
+			mssqlinformation.Errormessage = fmt.Sprintf("PRELOGIN option 0x%02x out of range", token)
+			return mssqlinformation
+		}
+		option := body[offset : offset+optionLength]
+
+		switch token {
+		case tdsOptionVersion:
+			if len(option) >= 6 {
+				mssqlinformation.Version = strconv.Itoa(int(option[0])) + "." + strconv.Itoa(int(option[1])) + "." + strconv.Itoa(int(binary.BigEndian.Uint16(option[2:4]))) + "." + strconv.Itoa(int(binary.BigEndian.Uint16(option[4:6])))
+				mssqlinformation.Product = mssqlProducts[option[0]]
+				if option[0] == 10 && option[1] == 50 {
+					mssqlinformation.Product = "SQL Server 2008 R2"
+				}
+			}
+		case tdsOptionEncryption:
+			if len(option) >= 1 {
+				mssqlinformation.Encryption = tdsEncryption[option[0]]
+				if mssqlinformation.Encryption == "" {
+					mssqlinformation.Encryption = fmt.Sprintf("0x%02x", option[0])
+				}
+			}
+		case tdsOptionInstOpt:
+			mssqlinformation.Instance = strings.TrimRight(string(option), "\x00")
+		case tdsOptionThreadID:
+			if len(option) >= 4 {
+				mssqlinformation.ThreadID = binary.BigEndian.Uint32(option)
+			}
+		case tdsOptionMARS:
+			if len(option) >= 1 {
+				mssqlinformation.MARS = option[0] == 0x01
+			}
+		}
+	}
+
+	mssqlinformation.Issql = true
+	return mssqlinformation
+}
+
+// Probe sends a PRELOGIN packet without encryption, so that the server
+// reveals whether it supports or requires it, and parses the response.
+func (m mssqlModule) Probe(conn net.Conn, config Config) interface{} {
+	mssqlinformation := MSSQLInformation{}
+	if address, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		mssqlinformation.IPAddress = address.IP.String()
+		mssqlinformation.DstPort = strconv.Itoa(address.Port)
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(config.Timeout) * time.Second))
+
+	if _, err := conn.Write(preLoginPacket()); err != nil {
+		mssqlinformation.Errormessage = err.Error()
+		return mssqlinformation
+	}
+
+	header := make([]byte, tdsHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		mssqlinformation.Errormessage = err.Error()
+		return mssqlinformation
+	}
+	length, ok := m.Match(header)
+	if !ok || length > tdsPreLoginLength {
+		mssqlinformation.Errormessage = "not a TDS PRELOGIN response"
+		return mssqlinformation
+	}
+	packet := make([]byte, length)
+	copy(packet, header)
+	if _, err := io.ReadFull(conn, packet[tdsHeaderLength:]); err != nil {
+		mssqlinformation.Errormessage = err.Error()
+		return mssqlinformation
+	}
+
+	parsed := m.Parse(packet).(MSSQLInformation)
+	parsed.IPAddress = mssqlinformation.IPAddress
+	parsed.DstPort = mssqlinformation.DstPort
+	return parsed
+}
+
+// preLoginPacket builds a PRELOGIN packet with the VERSION, ENCRYPTION,
+// INSTOPT, THREADID and MARS options.
+func preLoginPacket() []byte {
+	options := []struct {
+		token byte
+		data  []byte
+	}{
+		{tdsOptionVersion, []byte{0, 0, 0, 0, 0, 0}},
+		{tdsOptionEncryption, []byte{0x00}},
+		{tdsOptionInstOpt, []byte{0x00}},
+		{tdsOptionThreadID, []byte{0, 0, 0, 0}},
+		{tdsOptionMARS, []byte{0x00}},
+	}
+
+	// Option tokens are followed by their data
+	offset := len(options)*5 + 1
+	var tokens, data []byte
+	for _, option := range options {
+		tokens = append(tokens, option.token)
+		tokens = binary.BigEndian.AppendUint16(tokens, uint16(offset+len(data)))
+		tokens = binary.BigEndian.AppendUint16(tokens, uint16(len(option.data)))
+		data = append(data, option.data...)
+	}
+	tokens = append(tokens, tdsOptionTerminator)
+
+	packet := []byte{tdsPreLogin, tdsStatusEOM, 0, 0, 0, 0, 1, 0}
+	packet = append(append(packet, tokens...), data...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	return packet
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// preLoginResponse builds a PRELOGIN response from token and data pairs.
+func preLoginResponse(options ...[]byte) []byte {
+	offset := len(options)/2*5 + 1
+	var tokens, data []byte
+	for i := 0; i < len(options); i += 2 {
+		tokens = append(tokens, options[i][0])
+		tokens = binary.BigEndian.AppendUint16(tokens, uint16(offset+len(data)))
+		tokens = binary.BigEndian.AppendUint16(tokens, uint16(len(options[i+1])))
+		data = append(data, options[i+1]...)
+	}
+	tokens = append(tokens, tdsOptionTerminator)
+
+	packet := []byte{tdsTabularResult, tdsStatusEOM, 0, 0, 0, 0, 1, 0}
+	packet = append(append(packet, tokens...), data...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	return packet
+}
+
+// testPreLoginResponse is the response of SQL Server 2019 (15.0.2000.5) with
+// encryption off, as sent for a login without TLS.
+var testPreLoginResponse = preLoginResponse(
+	[]byte{tdsOptionVersion}, []byte{15, 0, 0x07, 0xd0, 0, 5},
+	[]byte{tdsOptionEncryption}, []byte{0x00},
+	[]byte{tdsOptionInstOpt}, []byte("MSSQLSERVER\x00"),
+	[]byte{tdsOptionThreadID}, []byte{0, 0, 0x12, 0x34},
+	[]byte{tdsOptionMARS}, []byte{0x01},
+)
+
+func TestParsePreLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    MSSQLInformation
+	}{
+		{
+			name:    "SQL Server 2019",
+			payload: testPreLoginResponse,
+			want: MSSQLInformation{Issql: true, Version: "15.0.2000.5", Product: "SQL Server 2019", Encryption: "ENCRYPT_OFF",
+				Instance: "MSSQLSERVER", ThreadID: 0x1234, MARS: true},
+		},
+		{
+			name: "SQL Server 2008 R2 requiring encryption",
+			payload: preLoginResponse([]byte{tdsOptionVersion}, []byte{10, 50, 0x06, 0x40, 0, 0},
+				[]byte{tdsOptionEncryption}, []byte{0x03}, []byte{tdsOptionThreadID}, nil),
+			want: MSSQLInformation{Issql: true, Version: "10.50.1600.0", Product: "SQL Server 2008 R2", Encryption: "ENCRYPT_REQ"},
+		},
+		{
+			name:    "unknown encryption",
+			payload: preLoginResponse([]byte{tdsOptionEncryption}, []byte{0x05}),
+			want:    MSSQLInformation{Issql: true, Encryption: "0x05"},
+		},
+		{
+			name:    "length past the packet",
+			payload: append(testPreLoginResponse[:tdsHeaderLength+1:tdsHeaderLength+1], 0x00, 0xff, 0x00, 0x06, tdsOptionTerminator),
+			want:    MSSQLInformation{Errormessage: "truncated TDS packet"},
+		},
+		{
+			name:    "not TDS",
+			payload: []byte("HTTP/1.1 400 Bad Request\r\n"),
+			want:    MSSQLInformation{Errormessage: "not a TDS PRELOGIN response"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := (mssqlModule{}).Parse(test.payload).(MSSQLInformation); got != test.want {
+				t.Errorf("Parse() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	// An option pointing past a packet whose length is correct
+	packet := preLoginResponse([]byte{tdsOptionVersion}, []byte{15, 0, 0x07, 0xd0, 0, 5})
+	binary.BigEndian.PutUint16(packet[tdsHeaderLength+3:], 0x40)
+	if got := (mssqlModule{}).Parse(packet).(MSSQLInformation); got.Errormessage != "PRELOGIN option 0x00 out of range" {
+		t.Errorf("Parse(option out of range) = %+v", got)
+	}
+
+	// Truncated responses must give an error, whatever the length field says
+	for length := 0; length < len(testPreLoginResponse); length++ {
+		for _, packetLength := range []int{length, len(testPreLoginResponse)} {
+			truncated := append([]byte(nil), testPreLoginResponse[:length]...)
+			if length >= 4 {
+				binary.BigEndian.PutUint16(truncated[2:4], uint16(packetLength))
+			}
+			if got := (mssqlModule{}).Parse(truncated).(MSSQLInformation); got.Errormessage == "" || got.Issql {
+				t.Fatalf("Parse(%d of %d bytes) = %+v, want an error", length, packetLength, got)
+			}
+		}
+	}
+}
+
+func TestMSSQLProbe(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		header := make([]byte, tdsHeaderLength)
+		if _, err := io.ReadFull(server, header); err != nil || header[0] != tdsPreLogin {
+			t.Errorf("got PRELOGIN header %x, %v", header, err)
+			return
+		}
+		io.ReadFull(server, make([]byte, int(binary.BigEndian.Uint16(header[2:4]))-tdsHeaderLength))
+		server.Write(testPreLoginResponse)
+	}()
+	defer client.Close()
+
+	got := mssqlModule{}.Probe(client, Config{Timeout: 2}).(MSSQLInformation)
+	if !got.Issql || got.Version != "15.0.2000.5" || got.Encryption != "ENCRYPT_OFF" {
+		t.Errorf("Probe() = %+v", got)
+	}
+}
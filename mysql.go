@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"net"
+	"time"
+)
+
+func init() {
+	RegisterModule(mysqlModule{})
+}
+
+// mysqlModule reads the greeting of the classic MySQL protocol, which the
+// server sends as soon as the connection is open.
+type mysqlModule struct{}
+
+func (mysqlModule) Name() string {
+	return "MySQL"
+}
+
+func (mysqlModule) BPFFragment() string {
+	return "tcp"
+}
+
+// Match checks the 3-byte length and zero sequence number of the first MySQL
+// packet.
+func (mysqlModule) Match(payload []byte) (int, bool) {
+	if len(payload) < 5 {
+		return 0, true
+	}
+	if payload[3] != 0x00 {
+		return 0, false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	return 4 + length, true
+}
+
+func (mysqlModule) Parse(payload []byte) interface{} {
+	mysqlFields, err := ParseGreeting(payload)
+	if err == ErrNotMySQL {
+		return MySQlInformation{Issql: false}
+	} else if err != nil {
+		return MySQlInformation{Issql: true, Parseerror: true, Errormessage: err.Error(), RawPayload: payload}
+	}
+	return mysqlFields
+}
+
+func (m mysqlModule) Probe(conn net.Conn, config Config) interface{} {
+	packet, err := NewSession(conn, time.Duration(config.Timeout)*time.Second).ReadPacket()
+	if err != nil {
+		return MySQlInformation{Issql: false, Errormessage: err.Error()}
+	}
+	return m.Parse(packet)
+}
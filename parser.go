@@ -18,10 +18,19 @@ package mysqlscanner
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 )
 
+// ErrNotMySQL is returned by ParseGreeting for payloads that do not look like
+// a MySQL greeting at all.
+var ErrNotMySQL = errors.New("not a MySQL greeting")
+
 type ServerCapabilities struct {
 	LONGPASSWORD                             bool
 	FOUNDROWS                                bool
@@ -53,6 +62,20 @@ type ServerCapabilities struct {
 	QUERYATTRIBUTES                          bool
 	MULTIFACTORAUTHENTICATION                bool
 	CAPABILITYEXTENSION                      bool
+	SSLVERIFYSERVERCERT                      bool
+	REMEMBEROPTIONS                          bool
+}
+
+// MariaDBCapabilities are the MARIADB_CLIENT_* capabilities that MariaDB
+// servers advertise in the last 4 reserved bytes of Handshake v10 when they
+// clear CLIENT_MYSQL.
+type MariaDBCapabilities struct {
+	PROGRESS           bool
+	COMMULTI           bool
+	STMTBULKOPERATIONS bool
+	EXTENDEDMETADATA   bool
+	CACHEMETADATA      bool
+	BULKUNITRESULTS    bool
 }
 
 type ServerStatus struct {
@@ -81,14 +104,57 @@ type MySQlInformation struct {
 	Version              int
 	VersionString        string
 	ThreadID             uint32
-	Salt1                string
+	Salt1                HexBytes
+	CapabilityFlags      uint32
 	ServerCapabilities   ServerCapabilities
-	ServerLanguage       string
+	MariaDBCapabilities  *MariaDBCapabilities `json:",omitempty"`
+	ServerLanguage       Collation
+	StatusFlags          uint16
 	ServerStatus         ServerStatus
-	Salt2                string
+	Salt2                HexBytes
 	AuthenticationPlugin string
+	Fingerprint          Fingerprint
+	RawHandshake         []byte `json:",omitempty"`
+	BannerHash           string `json:",omitempty"`
 	Errorcode            uint16
+	SQLState             string
+	ErrorClass           ErrorClass
 	Errormessage         string
+	Parseerror           bool
+	RawPayload           []byte                `json:",omitempty"`
+	TLS                  *TLSInformation       `json:",omitempty"`
+	Anonymous            *AnonymousAccess      `json:",omitempty"`
+	Authentication       []AuthResult          `json:",omitempty"`
+	PublicKey            *PublicKeyInformation `json:",omitempty"`
+	Variables            map[string]string     `json:",omitempty"`
+	QueryErrors          map[string]string     `json:",omitempty"`
+}
+
+// HexBytes is written to JSON as a hex string, for binary fields such as the
+// salts that are not valid UTF-8.
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+// fieldRange is the offset and length of a field in a payload.
+type fieldRange struct {
+	offset int
+	length int
+}
+
+// bannerHash hashes a handshake with its per-connection fields, the thread ID
+// and salts, zeroed, so that servers running the same build hash the same.
+func bannerHash(payload []byte, perConnection []fieldRange) string {
+	banner := append([]byte(nil), payload...)
+	for _, field := range perConnection {
+		for i := field.offset; i < field.offset+field.length && i < len(banner); i++ {
+			banner[i] = 0
+		}
+	}
+	sum := sha256.Sum256(banner)
+	return hex.EncodeToString(sum[:])
 }
 
 type MySQLError struct {
@@ -97,9 +163,22 @@ type MySQLError struct {
 	Issql        bool
 	Sqlerror     bool
 	Errorcode    uint16
+	SQLState     string
+	ErrorClass   ErrorClass
 	Errormessage string
 }
 
+// ParseError is written in place of a handshake that could not be parsed. It
+// carries the raw payload so the banner can be inspected later.
+type ParseError struct {
+	IPAddress    string
+	DstPort      string
+	Issql        bool
+	Parseerror   bool
+	Errormessage string
+	RawPayload   []byte
+}
+
 type TCPErrorStruct struct {
 	IPAddress    string
 	DstPort      string
@@ -107,36 +186,11 @@ type TCPErrorStruct struct {
 	Errormessage string
 }
 
-func parseLanguage(languagebit []byte) string {
-
-	if bytes.Equal(languagebit, []byte{0x01}) {
-		return "big5_chinese_ci"
-	} else if bytes.Equal(languagebit, []byte{0x02}) {
-		return "latin2_czech_cs"
-	} else if bytes.Equal(languagebit, []byte{0x03}) {
-		return "dec8_swedish_ci"
-	} else if bytes.Equal(languagebit, []byte{0x04}) {
-		return "cp850_general_ci"
-	} else if bytes.Equal(languagebit, []byte{0x05}) {
-		return "latin1_german1_ci"
-	} else if bytes.Equal(languagebit, []byte{0x06}) {
-		return "hp8_english_ci"
-	} else if bytes.Equal(languagebit, []byte{0x07}) {
-		return "koi8r_general_ci"
-	} else if bytes.Equal(languagebit, []byte{0x08}) {
-		return "latin1_swedish_ci"
-	} else if bytes.Equal(languagebit, []byte{0x09}) {
-		return "latin2_general_ci"
-	} else if bytes.Equal(languagebit, []byte{0x0a}) {
-		return "swe7_swedish_ci"
-	} else if bytes.Equal(languagebit, []byte{0x21}) {
-		return "utf8mb3_general_ci "
-	} else if bytes.Equal(languagebit, []byte{0x3f}) {
-		return "binary"
-	} else {
-		return "other"
+func parseLanguage(languagebit []byte) Collation {
+	if collation, ok := collations[languagebit[0]]; ok {
+		return collation
 	}
-
+	return Collation{ID: languagebit[0]}
 }
 
 func ParseBit(bit byte) bool {
@@ -147,127 +201,409 @@ func ParseBit(bit byte) bool {
 	}
 }
 
-func ParseCapabilities(capabilities []byte, capabilities_ext []byte) ServerCapabilities {
-	serverCapabilitiesObject := ServerCapabilities{}
-	attrNames := []string{"LOADDATALOCAL", "ODBCCLIENT", "CANUSECOMPRESSION", "DONTALLOWDATABASETABLECOLUMN", "CONNECTWITHDATABASE",
-		"LONGCOLUMNFLAGS", "FOUNDROWS", "LONGPASSWORD",
-		"CANDO41AUTH", "SPEAKS41OLD", "KNOWSABOUTTRANSACTIONS",
-		"IGNORESIGPIPES", "SWITCHTOSSLAFTERHANDSHAKE", "INTERACTIVECLIENT", "SPEAKS41NEW", "IGNORESPACESBEFOREPARENTHESIS"}
-	attrNamesExtended := []string{"SESSIONVARIABLETRACKING", "CLIENTCANHANDLEEXPIREDPASSWORDS", "PLUGINAUTHLENENC", "CONNECTATTRS", "PLUGINAUTH",
-		"PSMULTIPLERESULTS", "MULTIPLERESULTS", "MULITPLESTATEMENTS",
-		"", "", "CAPABILITYEXTENSION", "MULTIFACTORAUTHENTICATION", "QUERYATTRIBUTES", "ZSTDCOMPRESSIONALGORITHM",
-		"CLIENTCANHANDLEOPTIONALRESULTSETMETADATA", "DEPRECATEEOF"}
-
-	// Parse Capabilities
-	for i := 0; i < len(capabilities)*8; i++ {
-		bit := capabilities[i/8] & (1 << uint(7-i%8))
-		bool_value := ParseBit(bit)
-		value := reflect.ValueOf(&serverCapabilitiesObject).Elem().FieldByName(attrNames[i])
-		if value.CanSet() {
-			value.Set(reflect.ValueOf(bool_value))
-		}
-	}
+// flagField names the struct field set by one bit of a flags field.
+type flagField struct {
+	mask uint32
+	name string
+}
+
+// capabilityFlags lists every documented CLIENT_* capability flag.
+var capabilityFlags = []flagField{
+	{1 << 0, "LONGPASSWORD"},
+	{1 << 1, "FOUNDROWS"},
+	{1 << 2, "LONGCOLUMNFLAGS"},
+	{1 << 3, "CONNECTWITHDATABASE"},
+	{1 << 4, "DONTALLOWDATABASETABLECOLUMN"},
+	{1 << 5, "CANUSECOMPRESSION"},
+	{1 << 6, "ODBCCLIENT"},
+	{1 << 7, "LOADDATALOCAL"},
+	{1 << 8, "IGNORESPACESBEFOREPARENTHESIS"},
+	{1 << 9, "SPEAKS41NEW"},
+	{1 << 10, "INTERACTIVECLIENT"},
+	{1 << 11, "SWITCHTOSSLAFTERHANDSHAKE"},
+	{1 << 12, "IGNORESIGPIPES"},
+	{1 << 13, "KNOWSABOUTTRANSACTIONS"},
+	{1 << 14, "SPEAKS41OLD"},
+	{1 << 15, "CANDO41AUTH"},
+	{1 << 16, "MULITPLESTATEMENTS"},
+	{1 << 17, "MULTIPLERESULTS"},
+	{1 << 18, "PSMULTIPLERESULTS"},
+	{1 << 19, "PLUGINAUTH"},
+	{1 << 20, "CONNECTATTRS"},
+	{1 << 21, "PLUGINAUTHLENENC"},
+	{1 << 22, "CLIENTCANHANDLEEXPIREDPASSWORDS"},
+	{1 << 23, "SESSIONVARIABLETRACKING"},
+	{1 << 24, "DEPRECATEEOF"},
+	{1 << 25, "CLIENTCANHANDLEOPTIONALRESULTSETMETADATA"},
+	{1 << 26, "ZSTDCOMPRESSIONALGORITHM"},
+	{1 << 27, "QUERYATTRIBUTES"},
+	{1 << 28, "MULTIFACTORAUTHENTICATION"},
+	{1 << 29, "CAPABILITYEXTENSION"},
+	{1 << 30, "SSLVERIFYSERVERCERT"},
+	{1 << 31, "REMEMBEROPTIONS"},
+}
+
+// statusFlags lists every documented SERVER_STATUS_* flag. Bit 2 is the
+// pre-4.1 SERVER_MORE_RESULTS flag.
+var statusFlags = []flagField{
+	{1 << 0, "INTRANSACTION"},
+	{1 << 1, "AUTOCOMMIT"},
+	{1 << 2, "MULTIQUERY"},
+	{1 << 3, "MORERESULTS"},
+	{1 << 4, "BADINDEXUSED"},
+	{1 << 5, "NOINDEXUSED"},
+	{1 << 6, "CURSOREXISTS"},
+	{1 << 7, "LASTROWSENT"},
+	{1 << 8, "DATABASEDROPPED"},
+	{1 << 9, "NOBACKSLASHESCAPES"},
+	{1 << 10, "METADATACHANGED"},
+	{1 << 11, "QUERYWASSLOW"},
+	{1 << 12, "PSOUTPARAMS"},
+	{1 << 13, "INTRANSREADONLY"},
+	{1 << 14, "SESSIONSTATECHANGED"},
+}
 
-	// Parse Extended Capabilities
-	for i := 0; i < len(capabilities_ext)*8; i++ {
-		if attrNamesExtended[i] != "" {
-			bit := capabilities_ext[i/8] & (1 << uint(7-i%8))
-			bool_value := ParseBit(bit)
-			value := reflect.ValueOf(&serverCapabilitiesObject).Elem().FieldByName(attrNamesExtended[i])
-			if value.CanSet() {
-				value.Set(reflect.ValueOf(bool_value))
-			}
+// mariadbCapabilityFlags lists the MARIADB_CLIENT_* flags, shifted down from
+// the upper 32 bits of MariaDB's 64-bit capabilities.
+var mariadbCapabilityFlags = []flagField{
+	{1 << 0, "PROGRESS"},
+	{1 << 1, "COMMULTI"},
+	{1 << 2, "STMTBULKOPERATIONS"},
+	{1 << 3, "EXTENDEDMETADATA"},
+	{1 << 4, "CACHEMETADATA"},
+	{1 << 5, "BULKUNITRESULTS"},
+}
+
+// setFlags sets each boolean field of the struct pointed to by object to
+// whether its bit is set in flags.
+func setFlags(object interface{}, flags uint32, fields []flagField) {
+	objectValue := reflect.ValueOf(object).Elem()
+	for _, field := range fields {
+		value := objectValue.FieldByName(field.name)
+		if value.CanSet() {
+			value.SetBool(flags&field.mask != 0)
 		}
 	}
+}
 
+func ParseCapabilities(capabilities uint32) ServerCapabilities {
+	serverCapabilitiesObject := ServerCapabilities{}
+	setFlags(&serverCapabilitiesObject, capabilities, capabilityFlags)
 	return serverCapabilitiesObject
 }
 
-func parseServerStatus(serverstatus []byte) ServerStatus {
+func parseMariaDBCapabilities(capabilities uint32) MariaDBCapabilities {
+	mariadbCapabilitiesObject := MariaDBCapabilities{}
+	setFlags(&mariadbCapabilitiesObject, capabilities, mariadbCapabilityFlags)
+	return mariadbCapabilitiesObject
+}
+
+func parseServerStatus(serverstatus uint16) ServerStatus {
 	serverStatusObject := ServerStatus{}
+	setFlags(&serverStatusObject, uint32(serverstatus), statusFlags)
+	return serverStatusObject
+}
+
+func ParseGreeting(applicationPayload []byte) (MySQlInformation, error) {
+	if len(applicationPayload) < 5 {
+		return MySQlInformation{Issql: false}, ErrNotMySQL
+	}
+
+	// Based on LZR MySQL identification criteria
+	var mysqlinformation MySQlInformation
+	var err error
+	if bytes.Equal([]byte(applicationPayload[3:4]), []byte{0x00}) && bytes.Equal([]byte(applicationPayload[4:5]), []byte{0x0a}) {
+		mysqlinformation, err = ParseMySQL(applicationPayload)
+	} else if bytes.Equal([]byte(applicationPayload[3:4]), []byte{0x00}) && bytes.Equal([]byte(applicationPayload[4:5]), []byte{0x09}) {
+		mysqlinformation, err = ParseMySQLV9(applicationPayload)
+	} else if bytes.Equal([]byte(applicationPayload[3:4]), []byte{0x00}) && bytes.Equal([]byte(applicationPayload[4:5]), []byte{0xff}) {
+		return ParseMySQLError(applicationPayload)
+	} else {
+		return MySQlInformation{Issql: false}, ErrNotMySQL
+	}
+
+	if err == nil {
+		mysqlinformation.Fingerprint = FingerprintHandshake(mysqlinformation)
+		mysqlinformation.RawHandshake = applicationPayload
+	}
+	return mysqlinformation, err
+}
+
+// payloadReader reads fields from a packet payload, returning an error rather
+// than panicking when the payload is shorter than the field being read.
+type payloadReader struct {
+	payload []byte
+	offset  int
+}
+
+func (r *payloadReader) remaining() int {
+	return len(r.payload) - r.offset
+}
+
+func (r *payloadReader) next(n int) ([]byte, error) {
+	if n < 0 || n > r.remaining() {
+		return nil, fmt.Errorf("truncated payload: need %d bytes at offset %d, have %d", n, r.offset, r.remaining())
+	}
+	field := r.payload[r.offset : r.offset+n]
+	r.offset += n
+	return field, nil
+}
+
+func (r *payloadReader) readByte() (byte, error) {
+	field, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return field[0], nil
+}
+
+func (r *payloadReader) readUint16() (uint16, error) {
+	field, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(field), nil
+}
+
+func (r *payloadReader) readUint32() (uint32, error) {
+	field, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(field), nil
+}
 
-	attrNames := []string{"LASTROWSENT", "CURSOREXISTS", "NOINDEXUSED", "BADINDEXUSED ", "MORERESULTS", "MULTIQUERY", "AUTOCOMMIT", "INTRANSACTION",
-		"", "SESSIONSTATECHANGED", "INTRANSREADONLY", "PSOUTPARAMS", "QUERYWASSLOW", "METADATACHANGED", "NOBACKSLASHESCAPES", "DATABASEDROPPED"}
-
-	for i := 0; i < len(serverstatus)*8; i++ {
-		if attrNames[i] != "" {
-			bit := serverstatus[i/8] & (1 << uint(7-i%8))
-			bool_value := ParseBit(bit)
-			value := reflect.ValueOf(&serverStatusObject).Elem().FieldByName(attrNames[i])
-			if value.CanSet() {
-				value.Set(reflect.ValueOf(bool_value))
-			}
+// readNullString reads a NUL terminated string. If requireNull is false, a
+// string running to the end of the payload is also accepted.
+func (r *payloadReader) readNullString(requireNull bool) (string, error) {
+	end := bytes.IndexByte(r.payload[r.offset:], 0)
+	if end < 0 {
+		if requireNull {
+			return "", fmt.Errorf("unterminated string at offset %d", r.offset)
 		}
+		field, _ := r.next(r.remaining())
+		return string(field), nil
 	}
-	return serverStatusObject
+	field, _ := r.next(end + 1)
+	return string(field[:end]), nil
 }
 
-func ParseMySQL(applicationPayload []byte) MySQlInformation {
+// readLengthEncodedInt reads a length-encoded integer. null is true for the
+// 0xfb marker used for NULL values in text result set rows.
+func (r *payloadReader) readLengthEncodedInt() (value uint64, null bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var size int
+	switch first {
+	case 0xfb:
+		return 0, true, nil
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	case 0xff:
+		return 0, false, fmt.Errorf("invalid length-encoded integer at offset %d", r.offset-1)
+	default:
+		return uint64(first), false, nil
+	}
+
+	field, err := r.next(size)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := size - 1; i >= 0; i-- {
+		value = value<<8 | uint64(field[i])
+	}
+	return value, false, nil
+}
+
+// readLengthEncodedString reads a string prefixed with its length-encoded
+// length.
+func (r *payloadReader) readLengthEncodedString() (value string, null bool, err error) {
+	length, null, err := r.readLengthEncodedInt()
+	if err != nil || null {
+		return "", null, err
+	}
+	if length > uint64(r.remaining()) {
+		return "", false, fmt.Errorf("truncated payload: need %d bytes at offset %d, have %d", length, r.offset, r.remaining())
+	}
+	field, _ := r.next(int(length))
+	return string(field), false, nil
+}
+
+func ParseMySQL(applicationPayload []byte) (MySQlInformation, error) {
 
 	mysqlinformation := MySQlInformation{Issql: true}
-	mysqlinformation.Version = int(applicationPayload[4])
+	reader := payloadReader{payload: applicationPayload, offset: 4}
+	var perConnection []fieldRange
 
-	end := 5 + 1
-	for i := end; i < len(applicationPayload); i++ {
-		if applicationPayload[i] == 0 {
-			end = i
-			break
-		}
+	// Add Version
+	version, err := reader.readByte()
+	if err != nil {
+		return mysqlinformation, err
 	}
+	mysqlinformation.Version = int(version)
 
 	// Add Version String
-	mysqlinformation.VersionString = string(applicationPayload[5:end])
+	if mysqlinformation.VersionString, err = reader.readNullString(true); err != nil {
+		return mysqlinformation, err
+	}
 
 	// Add ThreadID
-	mysqlinformation.ThreadID = binary.LittleEndian.Uint32(applicationPayload[end+1 : end+5])
-	end = end + 5
+	perConnection = append(perConnection, fieldRange{reader.offset, 4})
+	if mysqlinformation.ThreadID, err = reader.readUint32(); err != nil {
+		return mysqlinformation, err
+	}
 
 	// Add Salt 1
-	mysqlinformation.Salt1 = string(applicationPayload[end : end+8])
-	end = end + 9
+	perConnection = append(perConnection, fieldRange{reader.offset, 8})
+	salt1, err := reader.next(8)
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.Salt1 = HexBytes(salt1)
+
+	// Skip Filler
+	if _, err = reader.next(1); err != nil {
+		return mysqlinformation, err
+	}
 
 	// Add Capabilities
-	mysqlinformation.ServerCapabilities = ParseCapabilities(applicationPayload[end:end+2], applicationPayload[end+5:end+7])
-	end = end + 2
+	capabilities, err := reader.readUint16()
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.CapabilityFlags = uint32(capabilities)
+	mysqlinformation.ServerCapabilities = ParseCapabilities(mysqlinformation.CapabilityFlags)
+	if reader.remaining() == 0 {
+		// Servers may end the handshake after the lower capability flags
+		mysqlinformation.BannerHash = bannerHash(applicationPayload, perConnection)
+		return mysqlinformation, nil
+	}
 
 	//  Add Language
-	mysqlinformation.ServerLanguage = parseLanguage(applicationPayload[end : end+1])
-	end = end + 1
+	language, err := reader.next(1)
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.ServerLanguage = parseLanguage(language)
 
 	// Add Server Status
-	mysqlinformation.ServerStatus = parseServerStatus(applicationPayload[end : end+2])
-	end = end + 4
+	if mysqlinformation.StatusFlags, err = reader.readUint16(); err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.ServerStatus = parseServerStatus(mysqlinformation.StatusFlags)
 
-	// Add Auth Plugin
-	salt_end := len(applicationPayload)
-	if bytes.Equal(applicationPayload[end:end+1], []byte{0x00}) {
-	} else {
-		length := int(applicationPayload[end : end+1][0])
-		mysqlinformation.AuthenticationPlugin = string(applicationPayload[len(applicationPayload)-length-1 : len(applicationPayload)])
-		salt_end = len(applicationPayload) - length - 1
+	// Add Extended Capabilities
+	capabilitiesExtended, err := reader.readUint16()
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.CapabilityFlags |= uint32(capabilitiesExtended) << 16
+	mysqlinformation.ServerCapabilities = ParseCapabilities(mysqlinformation.CapabilityFlags)
+
+	// Add Auth Plugin Data Length
+	authDataLength, err := reader.readByte()
+	if err != nil {
+		return mysqlinformation, err
+	}
+
+	// Add MariaDB Capabilities from the Reserved Bytes
+	reserved, err := reader.next(10)
+	if err != nil {
+		return mysqlinformation, err
+	}
+	if !mysqlinformation.ServerCapabilities.LONGPASSWORD {
+		mariadbCapabilities := parseMariaDBCapabilities(binary.LittleEndian.Uint32(reserved[6:10]))
+		mysqlinformation.MariaDBCapabilities = &mariadbCapabilities
 	}
 
 	// Add Second Salt
-	end = end + 1
-	salt_begin := 0
-	for i := end; i < len(applicationPayload); i++ {
-		if applicationPayload[i] != 0 {
-			salt_begin = i
-			break
+	if mysqlinformation.ServerCapabilities.CANDO41AUTH {
+		saltLength := int(authDataLength) - 8
+		if saltLength < 13 {
+			saltLength = 13
+		}
+		if saltLength > reader.remaining() {
+			saltLength = reader.remaining()
 		}
+		perConnection = append(perConnection, fieldRange{reader.offset, saltLength})
+		salt2, _ := reader.next(saltLength)
+		mysqlinformation.Salt2 = HexBytes(bytes.TrimRight(salt2, "\x00"))
+	}
+
+	// Add Auth Plugin
+	if mysqlinformation.ServerCapabilities.PLUGINAUTH {
+		if mysqlinformation.AuthenticationPlugin, err = reader.readNullString(false); err != nil {
+			return mysqlinformation, err
+		}
+	}
+	mysqlinformation.BannerHash = bannerHash(applicationPayload, perConnection)
+	return mysqlinformation, nil
+}
+
+// ParseMySQLV9 parses the legacy Handshake v9 sent by servers older than 4.1.
+// It carries only the version string, thread ID and a NUL terminated scramble.
+func ParseMySQLV9(applicationPayload []byte) (MySQlInformation, error) {
+
+	mysqlinformation := MySQlInformation{Issql: true}
+	reader := payloadReader{payload: applicationPayload, offset: 4}
+
+	// Add Version
+	version, err := reader.readByte()
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.Version = int(version)
+
+	// Add Version String
+	if mysqlinformation.VersionString, err = reader.readNullString(true); err != nil {
+		return mysqlinformation, err
+	}
+
+	// Add ThreadID
+	threadID := fieldRange{reader.offset, 4}
+	if mysqlinformation.ThreadID, err = reader.readUint32(); err != nil {
+		return mysqlinformation, err
+	}
+
+	// Add Scramble
+	scrambleOffset := reader.offset
+	scramble, err := reader.readNullString(false)
+	if err != nil {
+		return mysqlinformation, err
 	}
-	mysqlinformation.Salt2 = string(applicationPayload[salt_begin:salt_end])
-	return mysqlinformation
+	mysqlinformation.Salt1 = HexBytes(scramble)
+	mysqlinformation.BannerHash = bannerHash(applicationPayload, []fieldRange{threadID, {scrambleOffset, len(scramble)}})
+	return mysqlinformation, nil
 }
 
-func ParseMySQLError(applicationPayload []byte) MySQlInformation {
+func ParseMySQLError(applicationPayload []byte) (MySQlInformation, error) {
 	mysqlinformation := MySQlInformation{Issql: true, Sqlerror: true}
+	reader := payloadReader{payload: applicationPayload, offset: 5}
 
 	// Add Error Code
-	mysqlinformation.Errorcode = binary.LittleEndian.Uint16(applicationPayload[5:7])
+	errorCode, err := reader.readUint16()
+	if err != nil {
+		return mysqlinformation, err
+	}
+	mysqlinformation.Errorcode = errorCode
+	mysqlinformation.ErrorClass = classifyError(errorCode)
+
+	// Add SQL State, sent by 4.1+ servers after a '#' marker
+	if reader.remaining() >= 6 && reader.payload[reader.offset] == '#' {
+		sqlState, _ := reader.next(6)
+		mysqlinformation.SQLState = string(sqlState[1:])
+	}
 
 	// Add Text Error
-	mysqlinformation.Errormessage = string(applicationPayload[7:len(applicationPayload)])
-	return mysqlinformation
+	errorMessage, _ := reader.next(reader.remaining())
+	mysqlinformation.Errormessage = string(errorMessage)
+	return mysqlinformation, nil
 
 }
@@ -0,0 +1,216 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseGreeting(t *testing.T) {
+	greeting, err := ParseGreeting(testGreeting("caching_sha2_password", 0))
+	if err != nil {
+		t.Fatalf("ParseGreeting: %v", err)
+	}
+	if greeting.VersionString != "8.0.36" || greeting.ThreadID != 42 || greeting.AuthenticationPlugin != "caching_sha2_password" {
+		t.Errorf("got version %q, thread %d, plugin %q", greeting.VersionString, greeting.ThreadID, greeting.AuthenticationPlugin)
+	}
+	if salt := string(greeting.Salt1) + string(greeting.Salt2); salt != string(testSalt) {
+		t.Errorf("got salt %q, want %q", salt, testSalt)
+	}
+}
+
+// TestParseMySQLTruncated cuts a greeting short at each field. Servers may
+// end the handshake after the lower capability flags, so only cuts before
+// them, or partway through the rest, are errors.
+func TestParseMySQLTruncated(t *testing.T) {
+	greeting := testGreeting("mysql_native_password", 0)
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		{"version string", 8, true},
+		{"thread ID", 14, true},
+		{"salt", 20, true},
+		{"filler", 25, true},
+		{"lower capabilities", 26, true},
+		{"after lower capabilities", 27, false},
+		{"status", 29, true},
+		{"upper capabilities", 31, true},
+		{"reserved", 40, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseMySQL(greeting[:test.length])
+			if (err != nil) != test.wantErr {
+				t.Errorf("ParseMySQL(%d bytes) error %v, want error %v", test.length, err, test.wantErr)
+			}
+		})
+	}
+
+	// No cut may panic
+	for length := 5; length < len(greeting); length++ {
+		ParseGreeting(greeting[:length])
+	}
+}
+
+func TestParseMySQLV9Truncated(t *testing.T) {
+	greeting := []byte{0x12, 0, 0, 0, 0x09}
+	greeting = append(greeting, "3.23.58\x00"...)
+	greeting = append(greeting, 7, 0, 0, 0)
+	greeting = append(greeting, "scramble\x00"...)
+
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		{"version string", 8, true},
+		{"thread ID", 15, true},
+		{"scramble", 20, false},
+		{"complete", len(greeting), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseMySQLV9(greeting[:test.length])
+			if (err != nil) != test.wantErr {
+				t.Errorf("ParseMySQLV9(%d bytes) error %v, want error %v", test.length, err, test.wantErr)
+			}
+		})
+	}
+	for length := 5; length < len(greeting); length++ {
+		ParseGreeting(greeting[:length])
+	}
+}
+
+// TestParseMariaDBCapabilities checks that MariaDB's capabilities 32 to 37 are
+// read from the last reserved bytes once CLIENT_MYSQL is cleared.
+func TestParseMariaDBCapabilities(t *testing.T) {
+	greeting := testGreeting("mysql_native_password", 0)
+	greeting[25] &^= 0x01 // CLIENT_MYSQL
+	binary.LittleEndian.PutUint32(greeting[39:43], 1<<(34-32)|1<<(37-32))
+
+	mysqlinformation, err := ParseMySQL(greeting)
+	if err != nil {
+		t.Fatalf("ParseMySQL: %v", err)
+	}
+	want := MariaDBCapabilities{STMTBULKOPERATIONS: true, BULKUNITRESULTS: true}
+	if mysqlinformation.MariaDBCapabilities == nil || *mysqlinformation.MariaDBCapabilities != want {
+		t.Errorf("got MariaDB capabilities %+v, want %+v", mysqlinformation.MariaDBCapabilities, want)
+	}
+
+	if all := parseMariaDBCapabilities(0x3f); all != (MariaDBCapabilities{true, true, true, true, true, true}) {
+		t.Errorf("parseMariaDBCapabilities(0x3f) = %+v, want every capability", all)
+	}
+
+	// MySQL servers set CLIENT_MYSQL and leave the reserved bytes zero
+	mysqlinformation, _ = ParseMySQL(testGreeting("mysql_native_password", 0))
+	if mysqlinformation.MariaDBCapabilities != nil {
+		t.Errorf("got MariaDB capabilities %+v from a MySQL greeting", mysqlinformation.MariaDBCapabilities)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	capabilities := ParseCapabilities(1<<0 | 1<<11 | 1<<15 | 1<<19 | 1<<31)
+	want := ServerCapabilities{LONGPASSWORD: true, SWITCHTOSSLAFTERHANDSHAKE: true, CANDO41AUTH: true, PLUGINAUTH: true, REMEMBEROPTIONS: true}
+	if capabilities != want {
+		t.Errorf("ParseCapabilities() = %+v, want %+v", capabilities, want)
+	}
+
+	// The raw mask joins the lower and upper capability flags
+	mysqlinformation, err := ParseMySQL(testGreeting("mysql_native_password", 1<<11|1<<30))
+	if err != nil {
+		t.Fatalf("ParseMySQL: %v", err)
+	}
+	if mask := uint32(0x000fa20d | 1<<11 | 1<<30); mysqlinformation.CapabilityFlags != mask {
+		t.Errorf("got capability mask %#x, want %#x", mysqlinformation.CapabilityFlags, mask)
+	}
+	if !mysqlinformation.ServerCapabilities.SWITCHTOSSLAFTERHANDSHAKE || !mysqlinformation.ServerCapabilities.SSLVERIFYSERVERCERT {
+		t.Errorf("got capabilities %+v", mysqlinformation.ServerCapabilities)
+	}
+}
+
+func TestParseServerStatus(t *testing.T) {
+	tests := []struct {
+		flags uint16
+		want  ServerStatus
+	}{
+		{0x0002, ServerStatus{AUTOCOMMIT: true}},
+		{0x0001 | 0x2000, ServerStatus{INTRANSACTION: true, INTRANSREADONLY: true}},
+		{0x0200 | 0x4000, ServerStatus{NOBACKSLASHESCAPES: true, SESSIONSTATECHANGED: true}},
+	}
+	for _, test := range tests {
+		if got := parseServerStatus(test.flags); got != test.want {
+			t.Errorf("parseServerStatus(%#x) = %+v, want %+v", test.flags, got, test.want)
+		}
+	}
+
+	mysqlinformation, _ := ParseMySQL(testGreeting("mysql_native_password", 0))
+	if mysqlinformation.StatusFlags != 0x0002 || !mysqlinformation.ServerStatus.AUTOCOMMIT {
+		t.Errorf("got status flags %#x and %+v", mysqlinformation.StatusFlags, mysqlinformation.ServerStatus)
+	}
+}
+
+// TestBannerHash pins the banner hash input: the whole handshake packet,
+// header included, with the thread ID and both salts zeroed. The hash is
+// compared across scans, so changing it breaks existing results.
+func TestBannerHash(t *testing.T) {
+	greeting := testGreeting("caching_sha2_password", 0)
+	parsed, err := ParseGreeting(greeting)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zeroed := append([]byte(nil), greeting...)
+	copy(zeroed[12:16], make([]byte, 4))  // thread ID
+	copy(zeroed[16:24], make([]byte, 8))  // salt 1
+	copy(zeroed[43:56], make([]byte, 13)) // salt 2 and its NUL
+	sum := sha256.Sum256(zeroed)
+	if want := hex.EncodeToString(sum[:]); parsed.BannerHash != want {
+		t.Errorf("BannerHash %s, want the hash of the zeroed packet %s", parsed.BannerHash, want)
+	}
+	if want := "02ab050b141afbbd31eb09221bc4876efdfb55d6c6cec57c248c7de4b6129857"; parsed.BannerHash != want {
+		t.Errorf("BannerHash %s, want %s", parsed.BannerHash, want)
+	}
+
+	// Another connection to the same server hashes the same
+	other := append([]byte(nil), greeting...)
+	binary.LittleEndian.PutUint32(other[12:16], 7)
+	copy(other[16:24], "ABCDEFGH")
+	copy(other[43:55], "IJKLMNOPQRST")
+	if otherParsed, err := ParseGreeting(other); err != nil || otherParsed.BannerHash != parsed.BannerHash {
+		t.Errorf("BannerHash changed with the thread ID and salts: %s, %v", otherParsed.BannerHash, err)
+	}
+
+	// A different build does not
+	if otherParsed, _ := ParseGreeting(testGreeting("mysql_native_password", 0)); otherParsed.BannerHash == parsed.BannerHash {
+		t.Error("BannerHash unchanged with the auth plugin")
+	}
+}
+
+func TestHexBytesJSON(t *testing.T) {
+	encoded, err := json.Marshal(struct{ Salt HexBytes }{HexBytes{0x00, 0x7f, 0xff, 'a'}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Salt":"007fff61"}`; string(encoded) != want {
+		t.Errorf("got %s, want %s", encoded, want)
+	}
+}
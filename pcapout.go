@@ -0,0 +1,121 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng block and option codes used for packets, which NgWriter cannot
+// comment.
+const (
+	ngEnhancedPacketBlock = 6
+	ngOptionComment       = 1
+	ngOptionEnd           = 0
+)
+
+// PCAPWriter tees the packets accepted by the receiver into a pcapng file,
+// commenting each with the target it was attributed to.
+type PCAPWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewPCAPWriter(path string) (*PCAPWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &PCAPWriter{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// start writes the section header and the interface the packets were
+// captured on, once the capture's link type is known.
+func (w *PCAPWriter) start(config Config, linkType layers.LinkType, filter string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = "mysqlscanner"
+	intf := pcapgo.NgInterface{Name: config.Interface, Filter: filter, OS: runtime.GOOS, LinkType: linkType, TimestampResolution: 9}
+	ngWriter, err := pcapgo.NewNgWriterInterface(w.writer, intf, options)
+	if err != nil {
+		return err
+	}
+	return ngWriter.Flush()
+}
+
+// writePacket writes packet as an enhanced packet block with a comment naming
+// its target, e.g. "target 192.0.2.1:3306".
+func (w *PCAPWriter) writePacket(packet gopacket.Packet) error {
+	comment := ""
+	if ip, tcp := packetTCP(packet); tcp != nil {
+		comment = "target " + probeKey(ip, uint16(tcp.SrcPort))
+	}
+	data := packet.Data()
+	info := packet.Metadata().CaptureInfo
+	if info.Length < len(data) {
+		info.Length = len(data)
+	}
+
+	// Block header, packet data and options, each padded to 32 bits
+	block := make([]byte, 28, 28+len(data)+len(comment)+20)
+	block = append(block, data...)
+	block = append(block, make([]byte, (4-len(data)%4)%4)...)
+	if comment != "" {
+		block = binary.LittleEndian.AppendUint16(block, ngOptionComment)
+		block = binary.LittleEndian.AppendUint16(block, uint16(len(comment)))
+		block = append(block, comment...)
+		block = append(block, make([]byte, (4-len(comment)%4)%4)...)
+		block = binary.LittleEndian.AppendUint32(block, ngOptionEnd)
+	}
+	block = append(block, 0, 0, 0, 0)
+
+	timestamp := uint64(info.Timestamp.UnixNano())
+	binary.LittleEndian.PutUint32(block[0:4], ngEnhancedPacketBlock)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[8:12], 0)
+	binary.LittleEndian.PutUint32(block[12:16], uint32(timestamp>>32))
+	binary.LittleEndian.PutUint32(block[16:20], uint32(timestamp))
+	binary.LittleEndian.PutUint32(block[20:24], uint32(len(data)))
+	binary.LittleEndian.PutUint32(block[24:28], uint32(info.Length))
+	binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(block)))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := w.writer.Write(block)
+	return err
+}
+
+// Close flushes the packets written so far and closes the file.
+func (w *PCAPWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
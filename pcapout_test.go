@@ -0,0 +1,142 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// capturedPacket builds a raw IPv4 packet from src:srcPort carrying
+// payloadLength bytes, captured at timestamp from a packet of length bytes on
+// the wire.
+func capturedPacket(t *testing.T, src string, srcPort uint16, payloadLength int, timestamp time.Time, length int) gopacket.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP("198.51.100.1")}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: 40000, ACK: true, PSH: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp, gopacket.Payload(bytes.Repeat([]byte{'x'}, payloadLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(buffer.Bytes()), Length: length}
+	return packet
+}
+
+func TestPCAPWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.pcapng")
+	writer, err := NewPCAPWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.start(Config{Interface: "eth0"}, layers.LinkTypeRaw, "tcp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packet and comment lengths cover every padding remainder
+	start := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	packets := []gopacket.Packet{
+		capturedPacket(t, "192.0.2.1", 33, 0, start, 0),
+		capturedPacket(t, "192.0.2.1", 3306, 1, start.Add(time.Millisecond), 1500),
+		capturedPacket(t, "192.0.2.10", 3306, 2, start.Add(time.Second), 0),
+		capturedPacket(t, "192.0.2.100", 3306, 3, start.Add(time.Hour), 0),
+		capturedPacket(t, "192.0.2.1", 330, 4, start.Add(2*time.Hour), 0),
+	}
+	comments := []string{"target 192.0.2.1:33", "target 192.0.2.1:3306", "target 192.0.2.10:3306", "target 192.0.2.100:3306", "target 192.0.2.1:330"}
+	for _, packet := range packets {
+		if err := writer.writePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the packets back
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intf, _ := reader.Interface(0); intf.Name != "eth0" || intf.Filter != "tcp" || reader.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("got interface %+v with link type %v", intf, reader.LinkType())
+	}
+	for i, packet := range packets {
+		data, info, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		wantLength := packet.Metadata().Length
+		if wantLength < len(packet.Data()) {
+			wantLength = len(packet.Data())
+		}
+		if !bytes.Equal(data, packet.Data()) || info.CaptureLength != len(packet.Data()) || info.Length != wantLength {
+			t.Errorf("packet %d: got %d of %d bytes, want %d of %d", i, info.CaptureLength, info.Length, len(packet.Data()), wantLength)
+		}
+		if !info.Timestamp.Equal(packet.Metadata().Timestamp) {
+			t.Errorf("packet %d: got timestamp %v, want %v", i, info.Timestamp, packet.Metadata().Timestamp)
+		}
+	}
+
+	// Walk the enhanced packet blocks for their comments
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for offset := 0; offset < len(contents); {
+		blockType := binary.LittleEndian.Uint32(contents[offset:])
+		blockLength := int(binary.LittleEndian.Uint32(contents[offset+4:]))
+		if blockLength%4 != 0 || binary.LittleEndian.Uint32(contents[offset+blockLength-4:]) != uint32(blockLength) {
+			t.Fatalf("block at %d has length %d and trailer %d", offset, blockLength, binary.LittleEndian.Uint32(contents[offset+blockLength-4:]))
+		}
+		if blockType == ngEnhancedPacketBlock {
+			captured := int(binary.LittleEndian.Uint32(contents[offset+20:]))
+			option := offset + 28 + (captured+3)/4*4
+			code := binary.LittleEndian.Uint16(contents[option:])
+			length := int(binary.LittleEndian.Uint16(contents[option+2:]))
+			end := option + 4 + (length+3)/4*4
+			if code != ngOptionComment || binary.LittleEndian.Uint32(contents[end:]) != ngOptionEnd || end+8 != offset+blockLength {
+				t.Errorf("block at %d: malformed options", offset)
+			}
+			found = append(found, string(contents[option+4:option+4+length]))
+		}
+		offset += blockLength
+	}
+	if len(found) != len(comments) {
+		t.Fatalf("got comments %q, want %q", found, comments)
+	}
+	for i := range comments {
+		if found[i] != comments[i] {
+			t.Errorf("packet %d: got comment %q, want %q", i, found[i], comments[i])
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// PostgreSQL request codes and protocol version.
+const (
+	postgresSSLRequest      = 80877103
+	postgresProtocolVersion = 196608
+)
+
+// postgresUsername is sent in the StartupMessage. Like publicKeyUsername it
+// is never logged in with.
+const postgresUsername = "mysqlscanner"
+
+// postgresMessageLimit bounds the messages read after the StartupMessage.
+const postgresMessageLimit = 64
+
+// postgresAuthenticationMethods names the AuthenticationRequest codes.
+var postgresAuthenticationMethods = map[uint32]string{
+	0:  "trust",
+	2:  "kerberos_v5",
+	3:  "cleartext",
+	5:  "md5",
+	6:  "scm_credential",
+	7:  "gss",
+	9:  "sspi",
+	10: "sasl",
+}
+
+// PostgreSQLInformation records a PostgreSQL server's reply to an SSLRequest
+// and, if a StartupMessage was sent, to the login that followed. Severity,
+// SQLState and Message come from an ErrorResponse. Parameters are only sent
+// by servers that let the dummy user in.
+type PostgreSQLInformation struct {
+	IPAddress            string
+	DstPort              string
+	Issql                bool
+	SSLResponse          string
+	TLS                  *TLSInformation   `json:",omitempty"`
+	AuthenticationCode   *uint32           `json:",omitempty"`
+	AuthenticationMethod string            `json:",omitempty"`
+	SASLMechanisms       []string          `json:",omitempty"`
+	Parameters           map[string]string `json:",omitempty"`
+	Severity             string            `json:",omitempty"`
+	SQLState             string            `json:",omitempty"`
+	Message              string            `json:",omitempty"`
+	Errormessage         string            `json:",omitempty"`
+}
+
+func init() {
+	RegisterModule(postgresModule{}, 5432)
+}
+
+// postgresModule probes PostgreSQL, which waits for the client to send an
+// SSLRequest or StartupMessage.
+type postgresModule struct{}
+
+func (postgresModule) Name() string {
+	return "PostgreSQL"
+}
+
+func (postgresModule) BPFFragment() string {
+	return ""
+}
+
+// Match checks for the single byte reply to an SSLRequest.
+func (postgresModule) Match(payload []byte) (int, bool) {
+	if len(payload) == 0 {
+		return 0, true
+	}
+	return 1, payload[0] == 'S' || payload[0] == 'N'
+}
+
+func (postgresModule) Parse(payload []byte) interface{} {
+	pginformation := PostgreSQLInformation{}
+	if len(payload) > 0 && (payload[0] == 'S' || payload[0] == 'N') {
+		pginformation.Issql = true
+		pginformation.SSLResponse = string(payload[:1])
+	} else {
+		pginformation.Errormessage = "not a PostgreSQL SSLRequest reply"
+	}
+	return pginformation
+}
+
+// Probe sends an SSLRequest, upgrading to TLS if the server accepts and TLS
+// or the StartupMessage was requested, and then optionally a StartupMessage
+// for a dummy user to learn the authentication method.
+func (m postgresModule) Probe(conn net.Conn, config Config) interface{} {
+	pginformation := PostgreSQLInformation{}
+	if address, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		pginformation.IPAddress = address.IP.String()
+		pginformation.DstPort = strconv.Itoa(address.Port)
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Send SSLRequest
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], postgresSSLRequest)
+	if _, err := conn.Write(request); err != nil {
+		pginformation.Errormessage = err.Error()
+		return pginformation
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		pginformation.Errormessage = err.Error()
+		return pginformation
+	}
+	switch reply[0] {
+	case 'S', 'N':
+		pginformation.Issql = true
+		pginformation.SSLResponse = string(reply)
+	case 'E':
+		// Servers older than 7.1 reject the SSLRequest
+		pginformation.Issql = true
+		if err := m.readError(conn, &pginformation); err != nil {
+			pginformation.Errormessage = err.Error()
+		}
+		return pginformation
+	default:
+		pginformation.Errormessage = fmt.Sprintf("unexpected SSLRequest reply 0x%02x", reply[0])
+		return pginformation
+	}
+
+	// Upgrade to TLS
+	if reply[0] == 'S' {
+		if !config.TLS && !config.PostgresStartup {
+			return pginformation
+		}
+		pginformation.TLS = &TLSInformation{ServerName: config.TLSServerName}
+		tlsConn, err := tlsClient(conn, config.TLSServerName, timeout, pginformation.TLS)
+		if err != nil {
+			pginformation.TLS.Errormessage = err.Error()
+			return pginformation
+		}
+		conn = tlsConn
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if !config.PostgresStartup {
+		return pginformation
+	}
+
+	// Send StartupMessage
+	var startup bytes.Buffer
+	binary.Write(&startup, binary.BigEndian, uint32(0))
+	binary.Write(&startup, binary.BigEndian, uint32(postgresProtocolVersion))
+	for _, parameter := range []string{"user", postgresUsername, "database", postgresUsername, "application_name", "mysqlscanner"} {
+		startup.WriteString(parameter)
+		startup.WriteByte(0)
+	}
+	startup.WriteByte(0)
+	message := startup.Bytes()
+	binary.BigEndian.PutUint32(message[0:4], uint32(len(message)))
+	if _, err := conn.Write(message); err != nil {
+		pginformation.Errormessage = err.Error()
+		return pginformation
+	}
+
+	for i := 0; i < postgresMessageLimit; i++ {
+		messageType, body, err := readPostgresMessage(conn)
+		if err != nil {
+			pginformation.Errormessage = err.Error()
+			return pginformation
+		}
+		reader := payloadReader{payload: body}
+
+		switch messageType {
+		case 'E':
+			// ErrorResponse
+			parsePostgresError(body, &pginformation)
+			return pginformation
+
+		case 'R':
+			// AuthenticationRequest
+			field, err := reader.next(4)
+			if err != nil {
+				pginformation.Errormessage = err.Error()
+				return pginformation
+			}
+			code := binary.BigEndian.Uint32(field)
+			pginformation.AuthenticationCode = &code
+			pginformation.AuthenticationMethod = postgresAuthenticationMethods[code]
+			if code == 10 {
+				for reader.remaining() > 0 {
+					mechanism, _ := reader.readNullString(false)
+					if mechanism == "" {
+						break
+					}
+					pginformation.SASLMechanisms = append(pginformation.SASLMechanisms, mechanism)
+				}
+			}
+			if code != 0 {
+				return pginformation
+			}
+
+		case 'S':
+			// ParameterStatus
+			name, _ := reader.readNullString(false)
+			value, _ := reader.readNullString(false)
+			if pginformation.Parameters == nil {
+				pginformation.Parameters = make(map[string]string)
+			}
+			pginformation.Parameters[name] = value
+
+		case 'Z':
+			// ReadyForQuery
+			return pginformation
+
+		case 'K', 'N', 'v':
+			// BackendKeyData, NoticeResponse and NegotiateProtocolVersion
+
+		default:
+			pginformation.Errormessage = fmt.Sprintf("unexpected PostgreSQL message type 0x%02x", messageType)
+			return pginformation
+		}
+	}
+	return pginformation
+}
+
+// readError reads the remainder of an ErrorResponse whose type byte has
+// already been read.
+func (postgresModule) readError(conn net.Conn, pginformation *PostgreSQLInformation) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	body, err := readPostgresBody(conn, header)
+	if err != nil {
+		return err
+	}
+	parsePostgresError(body, pginformation)
+	return nil
+}
+
+// readPostgresMessage reads a backend message: a type byte and a 4-byte
+// big-endian length covering itself and the body.
+func readPostgresMessage(conn net.Conn) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	body, err := readPostgresBody(conn, header[1:])
+	return header[0], body, err
+}
+
+func readPostgresBody(conn net.Conn, length []byte) ([]byte, error) {
+	bodyLength := binary.BigEndian.Uint32(length)
+	if bodyLength < 4 || bodyLength > maxPacketLength {
+		return nil, errors.New("not a PostgreSQL message length: " + strconv.Itoa(int(bodyLength)))
+	}
+	body := make([]byte, bodyLength-4)
+	_, err := io.ReadFull(conn, body)
+	return body, err
+}
+
+// parsePostgresError reads the severity, SQLSTATE and message fields of an
+// ErrorResponse, preferring the non-localized severity when sent.
+func parsePostgresError(body []byte, pginformation *PostgreSQLInformation) {
+	reader := payloadReader{payload: body}
+	for reader.remaining() > 0 {
+		fieldType, _ := reader.readByte()
+		if fieldType == 0 {
+			break
+		}
+		value, _ := reader.readNullString(false)
+		switch fieldType {
+		case 'S':
+			if pginformation.Severity == "" {
+				pginformation.Severity = value
+			}
+		case 'V':
+			pginformation.Severity = value
+		case 'C':
+			pginformation.SQLState = value
+		case 'M':
+			pginformation.Message = value
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// postgresMessage builds a backend message.
+func postgresMessage(messageType byte, body string) []byte {
+	message := []byte{messageType}
+	message = binary.BigEndian.AppendUint32(message, uint32(4+len(body)))
+	return append(message, body...)
+}
+
+// probePostgres runs the PostgreSQL probe against a fake server that answers
+// the SSLRequest with reply and, if the StartupMessage is sent, with
+// messages.
+func probePostgres(t *testing.T, config Config, reply []byte, messages []byte) PostgreSQLInformation {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(server, request); err != nil {
+			t.Errorf("read SSLRequest: %v", err)
+			return
+		}
+		if binary.BigEndian.Uint32(request[4:]) != postgresSSLRequest {
+			t.Errorf("got SSLRequest %x", request)
+		}
+		server.Write(reply)
+		if !config.PostgresStartup {
+			return
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(server, header); err != nil {
+			return
+		}
+		startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+		if _, err := io.ReadFull(server, startup); err != nil {
+			t.Errorf("read StartupMessage: %v", err)
+			return
+		}
+		if binary.BigEndian.Uint32(startup) != postgresProtocolVersion || !bytes.Contains(startup, []byte("user\x00"+postgresUsername+"\x00")) {
+			t.Errorf("got StartupMessage %q", startup)
+		}
+		server.Write(messages)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	return postgresModule{}.Probe(client, config).(PostgreSQLInformation)
+}
+
+func TestPostgresProbe(t *testing.T) {
+	code := func(code uint32) *uint32 { return &code }
+	startup := Config{Timeout: 2, PostgresStartup: true}
+	tests := []struct {
+		name     string
+		config   Config
+		reply    []byte
+		messages []byte
+		want     PostgreSQLInformation
+	}{
+		{
+			name:   "SSL refused",
+			config: Config{Timeout: 2},
+			reply:  []byte("N"),
+			want:   PostgreSQLInformation{Issql: true, SSLResponse: "N"},
+		},
+		{
+			name:     "SCRAM",
+			config:   startup,
+			reply:    []byte("N"),
+			messages: postgresMessage('R', "\x00\x00\x00\x0aSCRAM-SHA-256\x00SCRAM-SHA-256-PLUS\x00\x00"),
+			want: PostgreSQLInformation{Issql: true, SSLResponse: "N", AuthenticationCode: code(10), AuthenticationMethod: "sasl",
+				SASLMechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}},
+		},
+		{
+			name:     "MD5",
+			config:   startup,
+			reply:    []byte("N"),
+			messages: postgresMessage('R', "\x00\x00\x00\x05salt"),
+			want:     PostgreSQLInformation{Issql: true, SSLResponse: "N", AuthenticationCode: code(5), AuthenticationMethod: "md5"},
+		},
+		{
+			name:   "trust",
+			config: startup,
+			reply:  []byte("N"),
+			messages: concatBytes(postgresMessage('R', "\x00\x00\x00\x00"), postgresMessage('S', "server_version\x0016.2\x00"),
+				postgresMessage('K', "\x00\x00\x00\x01\x00\x00\x00\x02"), postgresMessage('Z', "I")),
+			want: PostgreSQLInformation{Issql: true, SSLResponse: "N", AuthenticationCode: code(0), AuthenticationMethod: "trust",
+				Parameters: map[string]string{"server_version": "16.2"}},
+		},
+		{
+			name:     "rejected",
+			config:   startup,
+			reply:    []byte("N"),
+			messages: postgresMessage('E', "SFATAL\x00VFATAL\x00C28000\x00Mno pg_hba.conf entry\x00\x00"),
+			want:     PostgreSQLInformation{Issql: true, SSLResponse: "N", Severity: "FATAL", SQLState: "28000", Message: "no pg_hba.conf entry"},
+		},
+		{
+			name:   "SSLRequest rejected by an old server",
+			config: Config{Timeout: 2},
+			reply:  postgresMessage('E', "SFATAL\x00C08P01\x00Munsupported frontend protocol\x00\x00"),
+			want:   PostgreSQLInformation{Issql: true, Severity: "FATAL", SQLState: "08P01", Message: "unsupported frontend protocol"},
+		},
+		{
+			name:   "not PostgreSQL",
+			config: Config{Timeout: 2},
+			reply:  []byte("J"),
+			want:   PostgreSQLInformation{Errormessage: "unexpected SSLRequest reply 0x4a"},
+		},
+		{
+			name:     "truncated authentication request",
+			config:   startup,
+			reply:    []byte("N"),
+			messages: postgresMessage('R', "\x00\x00"),
+			want:     PostgreSQLInformation{Issql: true, SSLResponse: "N", Errormessage: "truncated payload: need 4 bytes at offset 0, have 2"},
+		},
+		{
+			name:     "invalid message length",
+			config:   startup,
+			reply:    []byte("N"),
+			messages: []byte{'R', 0, 0, 0, 3},
+			want:     PostgreSQLInformation{Issql: true, SSLResponse: "N", Errormessage: "not a PostgreSQL message length: 3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := probePostgres(t, test.config, test.reply, test.messages)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Probe() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPostgresParse(t *testing.T) {
+	if got := (postgresModule{}).Parse([]byte("S")).(PostgreSQLInformation); !got.Issql || got.SSLResponse != "S" {
+		t.Errorf("Parse(S) = %+v", got)
+	}
+	if got := (postgresModule{}).Parse(nil).(PostgreSQLInformation); got.Issql || got.Errormessage == "" {
+		t.Errorf("Parse(nil) = %+v, want an error", got)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// receiveWindow bounds how far past the start of the server's stream a data
+// segment may begin and still be attributed to a probe.
+const receiveWindow = 65535
+
+// finishedLifetime is how long a finished probe is remembered, so that the
+// rest of its connection and the active probes that follow it are not
+// counted as dropped. Finished probes are forgotten after between one and
+// two lifetimes.
+const finishedLifetime = 2 * time.Minute
+
+// probe is the expected TCP state of one outstanding connection. Fields that
+// are not known when the probe is sent are learned from the SYN-ACK.
+type probe struct {
+	localPort uint16
+	localSeq  uint32
+	remoteSeq uint32
+	ackKnown  bool
+	seqKnown  bool
+}
+
+// ProbeTable records every probe that has been sent so that captured packets
+// can be matched against the connection they claim to belong to. Packets that
+// do not match an outstanding probe are dropped, and counted unless the
+// probe to their address has recently finished.
+type ProbeTable struct {
+	lock     sync.Mutex
+	probes   map[string]*probe
+	finished map[string]struct{}
+	retired  map[string]struct{}
+	rotated  time.Time
+	dropped  uint64
+}
+
+func NewProbeTable() *ProbeTable {
+	return &ProbeTable{probes: make(map[string]*probe), finished: make(map[string]struct{}), rotated: time.Now()}
+}
+
+// probeKey formats a remote address the same way targets are keyed when
+// dialing, e.g. 192.0.2.1:3306 or [2001:db8::1]:3306.
+func probeKey(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// Add registers a probe to key before its SYN is sent. localPort may be 0 if
+// the kernel has not yet chosen it, in which case it is learned from the
+// first packet of the connection.
+func (p *ProbeTable) Add(key string, localPort uint16) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.probes[key] = &probe{localPort: localPort}
+}
+
+// addRaw registers a raw mode probe, for which the initial sequence number is
+// known up front.
+func (p *ProbeTable) addRaw(key string, localPort uint16, seq uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.probes[key] = &probe{localPort: localPort, localSeq: seq + 1, ackKnown: true}
+}
+
+// SetLocalPort records the local port of a dialed connection.
+func (p *ProbeTable) SetLocalPort(key string, localPort uint16) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if outstanding, ok := p.probes[key]; ok {
+		outstanding.localPort = localPort
+	}
+}
+
+// Remove stops accepting packets for key once its result has been recorded.
+func (p *ProbeTable) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.probes[key]; !ok {
+		return
+	}
+	delete(p.probes, key)
+
+	// Remember the finished probe for a lifetime in two generations
+	if now := time.Now(); now.Sub(p.rotated) >= finishedLifetime {
+		p.retired = p.finished
+		p.finished = make(map[string]struct{})
+		p.rotated = now
+	}
+	p.finished[key] = struct{}{}
+}
+
+// established reports whether the probe to key has had a SYN-ACK.
+func (p *ProbeTable) established(key string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	outstanding, ok := p.probes[key]
+	return ok && outstanding.seqKnown
+}
+
+// Dropped returns the number of packets that did not match any probe.
+func (p *ProbeTable) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// validate reports whether packet belongs to an outstanding probe, matching
+// the remote address and port, our local port and the sequence and
+// acknowledgement numbers of the handshake.
+func (p *ProbeTable) validate(packet gopacket.Packet) bool {
+	if p.match(packet) {
+		return true
+	}
+	if !p.recentlyFinished(packet) {
+		atomic.AddUint64(&p.dropped, 1)
+	}
+	return false
+}
+
+// recentlyFinished reports whether packet is from the address of a probe
+// that has finished, such as the server closing the connection or answering
+// the active probes.
+func (p *ProbeTable) recentlyFinished(packet gopacket.Packet) bool {
+	ip, tcp := packetTCP(packet)
+	if tcp == nil {
+		return false
+	}
+	key := probeKey(ip, uint16(tcp.SrcPort))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.finished[key]; ok {
+		return true
+	}
+	_, ok := p.retired[key]
+	return ok
+}
+
+func (p *ProbeTable) match(packet gopacket.Packet) bool {
+	ip, tcp := packetTCP(packet)
+	if tcp == nil {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	outstanding, ok := p.probes[probeKey(ip, uint16(tcp.SrcPort))]
+	if !ok {
+		return false
+	}
+
+	// Check Local Port
+	if outstanding.localPort == 0 {
+		outstanding.localPort = uint16(tcp.DstPort)
+	} else if outstanding.localPort != uint16(tcp.DstPort) {
+		return false
+	}
+
+	// Check Acknowledgement Number
+	if tcp.ACK {
+		if !outstanding.ackKnown && tcp.SYN {
+			outstanding.localSeq = tcp.Ack
+			outstanding.ackKnown = true
+		} else if outstanding.ackKnown && tcp.Ack != outstanding.localSeq {
+			return false
+		}
+	}
+
+	// Check Sequence Number
+	if tcp.SYN {
+		outstanding.remoteSeq = tcp.Seq + 1
+		outstanding.seqKnown = true
+	} else if outstanding.seqKnown && !tcp.RST && tcp.Seq-outstanding.remoteSeq > receiveWindow {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const testProbeKey = "192.0.2.1:3306"
+
+// testSegment is a TCP segment from a server, by default from the probed
+// target to local port 40000.
+type testSegment struct {
+	src     string
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	syn     bool
+	rst     bool
+}
+
+func (s testSegment) packet(t *testing.T) gopacket.Packet {
+	t.Helper()
+	if s.src == "" {
+		s.src = "192.0.2.1"
+	}
+	if s.srcPort == 0 {
+		s.srcPort = 3306
+	}
+	if s.dstPort == 0 {
+		s.dstPort = 40000
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(s.src), DstIP: net.ParseIP("198.51.100.1")}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(s.srcPort), DstPort: layers.TCPPort(s.dstPort), Seq: s.seq, Ack: s.ack, SYN: s.syn, RST: s.rst, ACK: !s.rst, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+func TestProbeTableMatch(t *testing.T) {
+	synAck := testSegment{seq: 1000, ack: 5001, syn: true}
+	tests := []struct {
+		name     string
+		add      func(table *ProbeTable)
+		segments []testSegment
+		want     []bool
+	}{
+		{
+			name:     "dial learns local port",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 0) },
+			segments: []testSegment{synAck, {seq: 1001, ack: 5001}, {seq: 1001, ack: 5001, dstPort: 40001}},
+			want:     []bool{true, true, false},
+		},
+		{
+			name:     "wrong local port",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 40001) },
+			segments: []testSegment{synAck},
+			want:     []bool{false},
+		},
+		{
+			name:     "wrong acknowledgement",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 40000) },
+			segments: []testSegment{synAck, {seq: 1001, ack: 6000}},
+			want:     []bool{true, false},
+		},
+		{
+			name:     "raw SYN-ACK acknowledging another sequence number",
+			add:      func(table *ProbeTable) { table.addRaw(testProbeKey, 40000, 5000) },
+			segments: []testSegment{{seq: 1000, ack: 5000, syn: true}, synAck},
+			want:     []bool{false, true},
+		},
+		{
+			name: "receive window",
+			add:  func(table *ProbeTable) { table.Add(testProbeKey, 40000) },
+			segments: []testSegment{synAck, {seq: 1001 + receiveWindow, ack: 5001},
+				{seq: 1002 + receiveWindow, ack: 5001}, {seq: 1000, ack: 5001}},
+			want: []bool{true, true, false, false},
+		},
+		{
+			name:     "sequence number wraparound",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 40000) },
+			segments: []testSegment{{seq: 0xffffff00, ack: 5001, syn: true}, {seq: 0x100, ack: 5001}},
+			want:     []bool{true, true},
+		},
+		{
+			name:     "reset outside the window",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 40000) },
+			segments: []testSegment{synAck, {seq: 1000000, rst: true}},
+			want:     []bool{true, true},
+		},
+		{
+			name:     "other address",
+			add:      func(table *ProbeTable) { table.Add(testProbeKey, 0) },
+			segments: []testSegment{{src: "192.0.2.2", seq: 1000, ack: 5001, syn: true}, {srcPort: 3307, seq: 1000, ack: 5001, syn: true}},
+			want:     []bool{false, false},
+		},
+		{
+			name: "removed",
+			add: func(table *ProbeTable) {
+				table.Add(testProbeKey, 0)
+				table.Remove(testProbeKey)
+			},
+			segments: []testSegment{synAck},
+			want:     []bool{false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := NewProbeTable()
+			test.add(table)
+			for i, segment := range test.segments {
+				if got := table.match(segment.packet(t)); got != test.want[i] {
+					t.Errorf("segment %d: match = %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTableDropped(t *testing.T) {
+	table := NewProbeTable()
+	finished := func(key string) {
+		table.Add(key, 0)
+		table.Remove(key)
+	}
+	packetFrom := func(src string) gopacket.Packet {
+		return testSegment{src: src, seq: 1000, ack: 5001, syn: true}.packet(t)
+	}
+
+	// A late packet from a finished probe is not counted
+	finished("192.0.2.1:3306")
+	table.validate(packetFrom("192.0.2.1"))
+	if dropped := table.Dropped(); dropped != 0 {
+		t.Errorf("dropped %d packets from a finished probe, want 0", dropped)
+	}
+	table.validate(packetFrom("192.0.2.9"))
+	if dropped := table.Dropped(); dropped != 1 {
+		t.Errorf("dropped %d packets from an unknown address, want 1", dropped)
+	}
+
+	// Finished probes survive one rotation and are forgotten after the second
+	table.rotated = time.Now().Add(-finishedLifetime)
+	finished("192.0.2.2:3306")
+	table.validate(packetFrom("192.0.2.1"))
+	if dropped := table.Dropped(); dropped != 1 {
+		t.Errorf("retired probe counted as dropped")
+	}
+	table.rotated = time.Now().Add(-finishedLifetime)
+	finished("192.0.2.3:3306")
+	table.validate(packetFrom("192.0.2.1"))
+	table.validate(packetFrom("192.0.2.2"))
+	if dropped := table.Dropped(); dropped != 2 {
+		t.Errorf("got %d dropped after the second rotation, want 2", dropped)
+	}
+
+	// Removing an unknown key does not rotate or remember it
+	table.Remove("192.0.2.9:3306")
+	table.validate(packetFrom("192.0.2.9"))
+	if dropped := table.Dropped(); dropped != 3 {
+		t.Errorf("got %d dropped after removing an unknown key, want 3", dropped)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// publicKeyUsername is sent when requesting a public key. The login is never
+// completed, so the user need not exist.
+const publicKeyUsername = "mysqlscanner"
+
+// publicKeyPlugins are the authentication plugins that hand out the server's
+// RSA public key.
+var publicKeyPlugins = map[string]bool{
+	"caching_sha2_password": true,
+	"sha256_password":       true,
+}
+
+// PublicKeyInformation describes the RSA key a server uses to encrypt
+// passwords sent without TLS. The fingerprint is the SHA-256 of the DER
+// encoded key, so that keys shared between servers can be found.
+type PublicKeyInformation struct {
+	PEM               string
+	Bits              int
+	SHA256Fingerprint string
+	Errormessage      string `json:",omitempty"`
+}
+
+// RequestPublicKey starts a login as a dummy user and asks for the server's
+// public key instead of sending a password. caching_sha2_password servers are
+// sent a random scramble so that fast authentication fails and the key can be
+// requested with 0x02, while sha256_password servers are asked with 0x01
+// straight away.
+func (s *Session) RequestPublicKey(greeting MySQlInformation) *PublicKeyInformation {
+	publickey := &PublicKeyInformation{}
+	plugin := greeting.AuthenticationPlugin
+
+	response, err := publicKeyRequest(plugin)
+	if err == nil {
+		err = s.WritePacket(handshakeResponse(publicKeyUsername, plugin, response, false))
+	}
+
+	for round := 0; err == nil; round++ {
+		if round == authRoundLimit {
+			err = errors.New("too many authentication rounds")
+			break
+		}
+		var packet []byte
+		if packet, err = s.ReadPacket(); err != nil {
+			break
+		}
+		if len(packet) < 5 {
+			err = errors.New("empty authentication packet")
+			break
+		}
+
+		switch packet[4] {
+		case 0xff:
+			// ERR
+			errorinformation, _ := ParseMySQLError(packet)
+			err = errors.New(errorinformation.Errormessage)
+
+		case 0xfe:
+			// AuthSwitchRequest
+			reader := payloadReader{payload: packet, offset: 5}
+			if plugin, err = reader.readNullString(false); err != nil {
+				break
+			}
+			if response, err = publicKeyRequest(plugin); err == nil {
+				err = s.WritePacket(response)
+			}
+
+		case 0x01:
+			// AuthMoreData
+			data := packet[5:]
+			if len(data) == 1 && data[0] == 0x04 {
+				err = s.WritePacket([]byte{0x02})
+				continue
+			} else if len(data) == 1 {
+				err = errors.New("public key not sent")
+				break
+			}
+			key, block, err := parsePublicKey(data)
+			if err != nil {
+				publickey.Errormessage = err.Error()
+				return publickey
+			}
+			fingerprint := sha256.Sum256(block.Bytes)
+			publickey.PEM = string(data)
+			publickey.Bits = key.N.BitLen()
+			publickey.SHA256Fingerprint = hex.EncodeToString(fingerprint[:])
+			return publickey
+
+		default:
+			err = errors.New("login completed without a public key")
+		}
+	}
+
+	publickey.Errormessage = err.Error()
+	return publickey
+}
+
+// publicKeyRequest returns the authentication response that leads plugin to
+// send its public key.
+func publicKeyRequest(plugin string) ([]byte, error) {
+	switch plugin {
+	case "caching_sha2_password":
+		scramble := make([]byte, sha256.Size)
+		_, err := rand.Read(scramble)
+		return scramble, err
+	case "sha256_password":
+		return []byte{0x01}, nil
+	}
+	return nil, errors.New("authentication plugin does not hand out a public key: " + plugin)
+}
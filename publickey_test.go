@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+)
+
+func TestRequestPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	fingerprint := sha256.Sum256(der)
+	published := PublicKeyInformation{PEM: string(keyPEM), Bits: 1024, SHA256Fingerprint: hex.EncodeToString(fingerprint[:])}
+
+	tests := []struct {
+		name     string
+		plugin   string
+		response []byte
+		// exchange answers the HandshakeResponse41 from sequence number 2
+		exchange func(server fakeServer)
+		want     PublicKeyInformation
+	}{
+		{
+			name:   "caching_sha2_password",
+			plugin: "caching_sha2_password",
+			exchange: func(server fakeServer) {
+				server.writePacket(2, []byte{0x01, 0x04})
+				if request := server.readPacket(3); string(request) != "\x02" {
+					t.Errorf("got key request %x, want 02", request)
+				}
+				server.writePacket(4, append([]byte{0x01}, keyPEM...))
+			},
+			want: published,
+		},
+		{
+			name:     "sha256_password",
+			plugin:   "sha256_password",
+			response: []byte{0x01},
+			exchange: func(server fakeServer) {
+				server.writePacket(2, append([]byte{0x01}, keyPEM...))
+			},
+			want: published,
+		},
+		{
+			name:   "access denied",
+			plugin: "caching_sha2_password",
+			exchange: func(server fakeServer) {
+				server.writePacket(2, accessDenied)
+			},
+			want: PublicKeyInformation{Errormessage: "Access denied for user"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			greeting, err := ParseGreeting(testGreeting(test.plugin, 0))
+			if err != nil {
+				t.Fatalf("ParseGreeting: %v", err)
+			}
+			session := pipeSession(t, func(server fakeServer) {
+				payload := server.readPacket(1)
+				if payload == nil {
+					return
+				}
+				username, response, plugin := handshakeResponseFields(t, payload)
+				if username != publicKeyUsername || plugin != test.plugin {
+					t.Errorf("got username %q and plugin %q", username, plugin)
+				}
+				if test.response != nil && string(response) != string(test.response) {
+					t.Errorf("got response %x, want %x", response, test.response)
+				} else if test.response == nil && len(response) != sha256.Size {
+					t.Errorf("got %d byte scramble, want %d", len(response), sha256.Size)
+				}
+				test.exchange(server)
+			})
+
+			if got := session.RequestPublicKey(greeting); *got != test.want {
+				t.Errorf("RequestPublicKey() = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// comQuery is the command byte of COM_QUERY.
+const comQuery = 0x03
+
+// queryRowLimit bounds the rows kept from a single result set.
+const queryRowLimit = 1000
+
+// readOnlyPrefixes are the statements --query accepts.
+var readOnlyPrefixes = []string{"SELECT ", "SHOW "}
+
+// readOnlyTransaction is run before the queries, so that the server refuses
+// any write that ValidateQuery did not catch.
+var readOnlyTransaction = []string{"SET SESSION TRANSACTION READ ONLY", "START TRANSACTION READ ONLY"}
+
+// queryCommentMarkers start comments, which can hide clauses from the checks
+// below (including version comments the server executes), and backticks,
+// which can quote them.
+var queryCommentMarkers = []string{"/*", "--", "#", "`"}
+
+// forbiddenClauses are clauses that write results to files or variables or
+// take locks, which are not harmless reads on someone else's server.
+var forbiddenClauses = []struct {
+	pattern *regexp.Regexp
+	message string
+}{
+	{regexp.MustCompile(`\bINTO\b`), "SELECT ... INTO is not allowed"},
+	{regexp.MustCompile(`\bFOR\s+(UPDATE|SHARE)\b`), "locking reads are not allowed"},
+	{regexp.MustCompile(`\bLOCK\s+IN\s+SHARE\s+MODE\b`), "locking reads are not allowed"},
+}
+
+// queryStringLiteral matches quoted strings, whose contents are not checked.
+// Backslashes are rejected before, as whether they escape a quote depends on
+// the server's sql_mode.
+var queryStringLiteral = regexp.MustCompile(`'([^']|'')*'|"([^"]|"")*"`)
+
+// queryCall matches a name followed by an opening parenthesis, which is a
+// function call or one of the operators in allowedCalls.
+var queryCall = regexp.MustCompile(`([A-Z_][A-Z0-9_$]*)\s*\(`)
+
+// allowedCalls are the functions and operators that may be followed by a
+// parenthesis. Any other function may have side effects, hold the connection
+// (BENCHMARK, SLEEP), read files (LOAD_FILE) or be user-defined.
+var allowedCalls = map[string]bool{
+	"VERSION":       true,
+	"USER":          true,
+	"CURRENT_USER":  true,
+	"SESSION_USER":  true,
+	"SYSTEM_USER":   true,
+	"DATABASE":      true,
+	"SCHEMA":        true,
+	"CONNECTION_ID": true,
+	"IN":            true,
+	"NOT":           true,
+	"AND":           true,
+	"OR":            true,
+	"WHERE":         true,
+	"LIKE":          true,
+	"SELECT":        true,
+	"FROM":          true,
+	"EXISTS":        true,
+}
+
+// ValidateQuery rejects statements that could change the server, as only
+// single SELECT and SHOW statements without comments, that do not write
+// their results anywhere, take locks or call functions outside allowedCalls,
+// are run. They are also run in a read-only transaction.
+func ValidateQuery(query string) error {
+	upper := strings.ToUpper(strings.Join(strings.Fields(query), " "))
+	readOnly := false
+	for _, prefix := range readOnlyPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			readOnly = true
+		}
+	}
+	if !readOnly {
+		return errors.New("only SELECT and SHOW statements are allowed")
+	}
+	if strings.Contains(upper, ";") {
+		return errors.New("only a single statement is allowed")
+	}
+	for _, marker := range queryCommentMarkers {
+		if strings.Contains(upper, marker) {
+			return errors.New("comments and backticks are not allowed")
+		}
+	}
+	if strings.Contains(upper, "\\") {
+		return errors.New("backslashes are not allowed")
+	}
+	unquoted := queryStringLiteral.ReplaceAllString(upper, "?")
+	if strings.ContainsAny(unquoted, "'\"") {
+		return errors.New("unterminated string")
+	}
+	for _, clause := range forbiddenClauses {
+		if clause.pattern.MatchString(unquoted) {
+			return errors.New(clause.message)
+		}
+	}
+	for _, call := range queryCall.FindAllStringSubmatch(unquoted, -1) {
+		if !allowedCalls[call[1]] {
+			return errors.New(call[1] + "() is not allowed")
+		}
+	}
+	return nil
+}
+
+// Variables decodes a result set into name/value pairs. SHOW VARIABLES and
+// SHOW STATUS style results give one pair per row, and other results give
+// one pair per column of their first row.
+func (r ResultSet) Variables() map[string]string {
+	variables := make(map[string]string)
+	if len(r.Columns) == 2 && strings.EqualFold(r.Columns[0], "Variable_name") {
+		for _, row := range r.Rows {
+			variables[row[0]] = row[1]
+		}
+	} else if len(r.Rows) > 0 {
+		for i, column := range r.Columns {
+			variables[column] = r.Rows[0][i]
+		}
+	}
+	return variables
+}
+
+// ResultSet is a text protocol result set. NULL values are returned as empty
+// strings.
+type ResultSet struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Query runs a statement with COM_QUERY on an authenticated session and
+// reads its text protocol result set. Statements that return no result set
+// give an empty ResultSet.
+func (s *Session) Query(query string) (ResultSet, error) {
+	resultset := ResultSet{}
+
+	// Every command starts a new sequence
+	s.sequence = 0
+	if err := s.WritePacket(append([]byte{comQuery}, query...)); err != nil {
+		return resultset, err
+	}
+
+	// Column Count
+	packet, err := s.readResultPacket()
+	if err != nil || packet[4] == 0x00 {
+		return resultset, err
+	}
+	reader := payloadReader{payload: packet, offset: 4}
+	columnCount, localInfile, err := reader.readLengthEncodedInt()
+	if err != nil {
+		return resultset, err
+	} else if localInfile {
+		return resultset, errors.New("server requested a LOCAL INFILE")
+	}
+
+	// Column Definitions
+	for i := uint64(0); i < columnCount; i++ {
+		if packet, err = s.readResultPacket(); err != nil {
+			return resultset, err
+		}
+		reader = payloadReader{payload: packet, offset: 4}
+
+		// Skip catalog, schema, table and org_table before the name
+		var name string
+		for field := 0; field < 5 && err == nil; field++ {
+			name, _, err = reader.readLengthEncodedString()
+		}
+		if err != nil {
+			return resultset, err
+		}
+		resultset.Columns = append(resultset.Columns, name)
+	}
+	if packet, err = s.readResultPacket(); err != nil {
+		return resultset, err
+	} else if !isEOFPacket(packet) {
+		return resultset, errors.New("missing EOF after column definitions")
+	}
+
+	// Rows
+	for {
+		if packet, err = s.readResultPacket(); err != nil {
+			return resultset, err
+		}
+		if isEOFPacket(packet) {
+			return resultset, nil
+		}
+		if len(resultset.Rows) == queryRowLimit {
+			continue
+		}
+
+		reader = payloadReader{payload: packet, offset: 4}
+		row := make([]string, len(resultset.Columns))
+		for i := range row {
+			if row[i], _, err = reader.readLengthEncodedString(); err != nil {
+				return resultset, err
+			}
+		}
+		resultset.Rows = append(resultset.Rows, row)
+	}
+}
+
+// readResultPacket reads the next packet of a command response, turning ERR
+// packets into errors.
+func (s *Session) readResultPacket() ([]byte, error) {
+	packet, err := s.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) < 5 {
+		return nil, errors.New("empty result packet")
+	}
+	if packet[4] == 0xff {
+		errorinformation, _ := ParseMySQLError(packet)
+		return nil, errors.New(errorinformation.Errormessage)
+	}
+	return packet, nil
+}
+
+// isEOFPacket reports whether packet is an EOF packet, which is shorter than
+// a row starting with a 0xfe length prefix would be.
+func isEOFPacket(packet []byte) bool {
+	return packet[4] == 0xfe && len(packet) < 4+9
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import "testing"
+
+func TestValidateQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		allowed bool
+	}{
+		{"SHOW VARIABLES LIKE 'have_ssl'", true},
+		{"SELECT @@require_secure_transport", true},
+		{"select version(), current_user()", true},
+		{"SHOW VARIABLES WHERE Variable_name IN ('port', 'sleep(1)')", true},
+		{"SELECT 'it''s', \"a \"\" b\"", true},
+		{"SELECT 'a\\'", false},
+		{"DROP TABLE t", false},
+		{"SELECT 1; DROP TABLE t", false},
+		{"SELECT 1 /*!50000 INTO OUTFILE 'x' */", false},
+		{"SELECT 1 INTO@a", false},
+		{"SELECT 1 FOR UPDATE", false},
+		{"SELECT SLEEP(1)", false},
+		{"SELECT BENCHMARK(1e10, SHA1('x'))", false},
+		{"SELECT LOAD_FILE('/etc/passwd')", false},
+		{"SELECT RELEASE_LOCK ('a')", false},
+		{"SELECT mydb.myfunction()", false},
+		{"SELECT 'a' INTO_X", true},
+		{"SELECT 'unterminated", false},
+		{"SELECT '\\' , SLEEP(1), '", false},
+	}
+	for _, test := range tests {
+		err := ValidateQuery(test.query)
+		if (err == nil) != test.allowed {
+			t.Errorf("ValidateQuery(%q) = %v, want allowed %v", test.query, err, test.allowed)
+		}
+	}
+}
+
+func TestQueryVariablesReadOnly(t *testing.T) {
+	prober := &ActiveProber{config: Config{Queries: []string{"SELECT @@port"}}}
+
+	t.Run("transaction refused", func(t *testing.T) {
+		session := pipeSession(t, func(server fakeServer) {
+			if statement := server.readPacket(0); string(statement) != "\x03SET SESSION TRANSACTION READ ONLY" {
+				t.Errorf("got first statement %q", statement)
+			}
+			server.writePacket(1, accessDenied)
+		})
+		var mysqlinformation MySQlInformation
+		prober.queryVariables(session, &mysqlinformation)
+		if _, ok := mysqlinformation.QueryErrors["SET SESSION TRANSACTION READ ONLY"]; !ok || len(mysqlinformation.QueryErrors) != 1 {
+			t.Errorf("got QueryErrors %v, want only the refused transaction", mysqlinformation.QueryErrors)
+		}
+	})
+
+	t.Run("queries in transaction", func(t *testing.T) {
+		session := pipeSession(t, func(server fakeServer) {
+			for _, statement := range append(readOnlyTransaction, "SELECT @@port") {
+				if got := server.readPacket(0); string(got) != "\x03"+statement {
+					t.Errorf("got statement %q, want %q", got, statement)
+				}
+				if statement == "SELECT @@port" {
+					server.writePacket(1, accessDenied)
+				} else {
+					server.writePacket(1, okPacket)
+				}
+			}
+		})
+		var mysqlinformation MySQlInformation
+		prober.queryVariables(session, &mysqlinformation)
+		if _, ok := mysqlinformation.QueryErrors["SELECT @@port"]; !ok || len(mysqlinformation.QueryErrors) != 1 {
+			t.Errorf("got QueryErrors %v, want only SELECT @@port", mysqlinformation.QueryErrors)
+		}
+	})
+}
@@ -20,71 +20,254 @@ limitations under the License.
 package mysqlscanner
 
 import (
-	"bytes"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
 )
 
-func handlePacket(packet gopacket.Packet) MySQlInformation {
-	// Get IP address
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		ipLayer = packet.Layer(layers.LayerTypeIPv6)
+// maxHandshakeLength bounds the first response a stream will buffer before
+// deciding the server is not speaking the protocol it appeared to.
+const maxHandshakeLength = 4096
+
+// handshakeStream buffers the server's side of one connection until the
+// first response, as framed by the module matching its first bytes, has
+// arrived.
+type handshakeStream struct {
+	receiver *receiver
+	ip       net.IP
+	port     uint16
+	module   Module
+	buffer   []byte
+	first    time.Time
+	done     bool
+}
+
+func (s *handshakeStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, reassembly := range reassemblies {
+		if s.done {
+			return
+		}
+		if reassembly.Skip != 0 && len(s.buffer) > 0 {
+			// Bytes are missing from the middle of the handshake
+			s.finish(s.buffer)
+			return
+		}
+		if len(s.buffer) == 0 {
+			s.first = reassembly.Seen
+		}
+		s.buffer = append(s.buffer, reassembly.Bytes...)
+		if len(s.buffer) == 0 {
+			continue
+		}
+
+		length, ok := s.match()
+		if !ok || length > maxHandshakeLength {
+			s.finish(s.buffer)
+		} else if length > 0 && len(s.buffer) >= length {
+			s.finish(s.buffer[:length])
+		}
+	}
+}
+
+// match frames the buffered bytes with the stream's module, choosing the
+// first passive module that accepts them if none has been chosen yet.
+func (s *handshakeStream) match() (int, bool) {
+	if s.module != nil {
+		return s.module.Match(s.buffer)
+	}
+	for _, module := range s.receiver.modules {
+		if length, ok := module.Match(s.buffer); ok {
+			s.module = module
+			return length, true
+		}
+	}
+	return 0, false
+}
+
+func (s *handshakeStream) ReassemblyComplete() {
+	if !s.done && len(s.buffer) > 0 {
+		s.finish(s.buffer)
+	}
+}
+
+func (s *handshakeStream) finish(payload []byte) {
+	s.done = true
+	result := Result{IPAddress: s.ip.String(), DstPort: strconv.Itoa(int(s.port))}
+	if s.module != nil {
+		result.Module = s.module.Name()
+		result.Record = s.module.Parse(payload)
+	}
+	s.receiver.emit(result, s.first)
+	if s.receiver.sender != nil {
+		s.receiver.sender.reset(s.ip, s.port)
+	}
+	s.buffer = nil
+}
+
+// receiver validates captured packets and reassembles the server's stream
+// for each probe, emitting one result per connection.
+type receiver struct {
+	assembler *tcpassembly.Assembler
+	results   chan Result
+	modules   []Module
+	sender    *RawSender
+	probes    *ProbeTable
+	tee       *PCAPWriter
+
+	// When buffered, results are held in pending until released, so that
+	// those finished together can be sorted
+	buffered bool
+	pending  []pendingResult
+}
+
+// pendingResult is a result held by a buffered receiver, with the time the
+// first byte of its stream was seen.
+type pendingResult struct {
+	result Result
+	first  time.Time
+}
+
+func newReceiver(results chan Result, sender *RawSender, probes *ProbeTable) *receiver {
+	r := &receiver{results: results, modules: PassiveModules(), sender: sender, probes: probes}
+	r.assembler = tcpassembly.NewAssembler(tcpassembly.NewStreamPool(r))
+	return r
+}
+
+// New implements tcpassembly.StreamFactory.
+func (r *receiver) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	srcPort := tcpFlow.Src().Raw()
+	return &handshakeStream{
+		receiver: r,
+		ip:       net.IP(netFlow.Src().Raw()),
+		port:     uint16(srcPort[0])<<8 | uint16(srcPort[1]),
+	}
+}
+
+func (r *receiver) handlePacket(packet gopacket.Packet) {
+	// Drop packets that were not sent in response to a probe
+	if r.probes != nil && !r.probes.validate(packet) {
+		return
+	}
+	if r.tee != nil {
+		if err := r.tee.writePacket(packet); err != nil {
+			log.Error("Write Capture Output: ", err)
+		}
 	}
+	if r.sender != nil {
+		if result, refused := r.sender.handleControl(packet); refused {
+			r.emit(result, packet.Metadata().Timestamp)
+			return
+		}
+	}
+
+	_, tcp := packetTCP(packet)
+	if tcp == nil || packet.NetworkLayer() == nil {
+		return
+	}
+	r.assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+}
 
-	ipString := ""
-	if ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		if ip == nil {
-			ip, _ := ipLayer.(*layers.IPv6)
-			ipString = ip.SrcIP.String()
-		} else {
-			ipString = ip.SrcIP.String()
+// emit sends a result, or holds it until released if the receiver is
+// buffered.
+func (r *receiver) emit(result Result, first time.Time) {
+	if !r.buffered {
+		r.results <- result
+		return
+	}
+	r.pending = append(r.pending, pendingResult{result: result, first: first})
+}
+
+// release sends the pending results in the order their streams started,
+// then by address and port. Streams flushed together are finished in the
+// assembler's map order, which changes from run to run.
+func (r *receiver) release() {
+	sort.SliceStable(r.pending, func(i, j int) bool {
+		a, b := r.pending[i], r.pending[j]
+		if !a.first.Equal(b.first) {
+			return a.first.Before(b.first)
+		}
+		if a.result.IPAddress != b.result.IPAddress {
+			return a.result.IPAddress < b.result.IPAddress
 		}
+		return a.result.DstPort < b.result.DstPort
+	})
+	for _, pending := range r.pending {
+		r.results <- pending.result
 	}
+	r.pending = nil
+}
 
-	// Get Port
-	tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
-	srcPort := strconv.Itoa(int(tcpLayer.SrcPort))
+// flush gives up on streams with missing data that have not been seen since
+// the given time, parsing whatever was received.
+func (r *receiver) flush(since time.Time) {
+	r.assembler.FlushWithOptions(tcpassembly.FlushOptions{T: since, CloseAll: true})
+}
 
-	// Get Application Layer
-	applicationLayer := packet.ApplicationLayer()
+// ReadHandshake reads the server's first response directly from conn instead
+// of capturing it, framing it with the passive modules just as captured
+// streams are. A connection closed or timed out before anything arrived is
+// reported in the result's Errormessage. The bytes read are returned in the
+// result's Payload, as they can no longer be read from conn.
+func ReadHandshake(conn net.Conn, timeout time.Duration) Result {
+	address, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if address == nil {
+		return Result{Errormessage: "not a TCP connection"}
+	}
+	r := &receiver{results: make(chan Result, 1), modules: PassiveModules()}
+	stream := &handshakeStream{receiver: r, ip: address.IP, port: uint16(address.Port)}
 
-	if applicationLayer != nil {
-		applicationPayload := applicationLayer.Payload()
-		// Based on LZR MySQL identification criteria
-		if bytes.Equal([]byte(applicationPayload[3:4]), []byte{0x00}) && bytes.Equal([]byte(applicationPayload[4:5]), []byte{0x0a}) {
-			mysqlFields := ParseMySQL(applicationPayload)
-			mysqlFields.IPAddress = ipString
-			mysqlFields.DstPort = srcPort
-			return mysqlFields
-		} else if bytes.Equal([]byte(applicationPayload[3:4]), []byte{0x00}) && bytes.Equal([]byte(applicationPayload[4:5]), []byte{0xff}) {
-			mysqlFields := ParseMySQLError(applicationPayload)
-			mysqlFields.IPAddress = ipString
-			mysqlFields.DstPort = srcPort
-			return mysqlFields
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, maxHandshakeLength)
+	var payload []byte
+	for !stream.done {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			payload = append(payload, buffer[:n]...)
+			stream.Reassembled([]tcpassembly.Reassembly{{Bytes: append([]byte(nil), buffer[:n]...)}})
+		}
+		if err != nil && !stream.done {
+			if len(stream.buffer) == 0 {
+				return Result{IPAddress: address.IP.String(), DstPort: strconv.Itoa(address.Port), Errormessage: err.Error()}
+			}
+			stream.ReassemblyComplete()
 		}
-		return MySQlInformation{Issql: false}
 	}
-	return MySQlInformation{Issql: false}
+	result := <-r.results
+	result.Payload = payload
+	return result
 }
 
-func ListenForPCAP(config Config, pcapChannel chan MySQlInformation, setupChannel chan string, validIP4 bool, validIP6 bool) {
+// BPFFilter builds the capture filter for the servers' replies to the given
+// source addresses. Without a source address the filter has no destination
+// clause, as when replaying a capture of an unknown scanner.
+func BPFFilter(config Config, validIP4 bool, validIP6 bool) string {
 	PcapFilterIPv6 := ""
 	PcapFilterIPv4 := ""
 	PcapFilter := ""
 
 	// BPF Filters adapted from LZR (github.com/stanford-esrg/lzr) and scanv6 (github.com/IPv6-Security/scanv6)
+	// Every segment carrying data is captured so that handshakes can be reassembled, along
+	// with SYN-ACKs to learn the sequence numbers of each connection and RSTs for raw mode.
 	if validIP6 == true {
-		PcapFilterIPv6 = fmt.Sprintf("((ip6 proto 6 && (ip6[53] & 8 != 0)) && ip6 dst %s)", config.SourceAddr6)
+		PcapFilterIPv6 = "(ip6 proto 6 && ((ip6[53] & 6 != 0) || (ip6[4:2] - ((ip6[52] & 0xf0) >> 2) != 0)))"
+		if config.SourceAddr6 != "" {
+			PcapFilterIPv6 = fmt.Sprintf("(%s && ip6 dst %s)", PcapFilterIPv6, config.SourceAddr6)
+		}
 	}
 	if validIP4 == true {
-		PcapFilterIPv4 = fmt.Sprintf("((ip proto 6 && (tcp[tcpflags] & tcp-push != 0)) && ip dst %s )", config.SourceAddr4)
+		PcapFilterIPv4 = "(ip proto 6 && ((tcp[tcpflags] & (tcp-syn|tcp-rst) != 0) || (ip[2:2] - ((ip[0] & 0xf) << 2) - ((tcp[12] & 0xf0) >> 2) != 0)))"
+		if config.SourceAddr4 != "" {
+			PcapFilterIPv4 = fmt.Sprintf("(%s && ip dst %s )", PcapFilterIPv4, config.SourceAddr4)
+		}
 	}
 
 	if validIP4 && validIP6 {
@@ -94,18 +277,107 @@ func ListenForPCAP(config Config, pcapChannel chan MySQlInformation, setupChanne
 	} else if validIP6 {
 		PcapFilter = PcapFilterIPv6
 	}
-    
+
+	// Only capture what the passive modules can parse
+	var fragments []string
+	for _, module := range PassiveModules() {
+		fragments = append(fragments, "("+module.BPFFragment()+")")
+	}
+	if len(fragments) > 0 {
+		PcapFilter = "(" + PcapFilter + ") && (" + strings.Join(fragments, " || ") + ")"
+	}
+	return PcapFilter
+}
+
+func ListenForPCAP(config Config, pcapChannel chan Result, setupChannel chan string, validIP4 bool, validIP6 bool, sender *RawSender, probes *ProbeTable, tee *PCAPWriter) {
+	PcapFilter := BPFFilter(config, validIP4, validIP6)
+
 	// Create Filters and Listen for Packets
 	if handle, err := pcap.OpenLive(config.Interface, 1600, true, pcap.BlockForever); err != nil {
 		log.Fatal("OpenLive: ", err)
 	} else if err := handle.SetBPFFilter(PcapFilter); err != nil {
 		log.Fatal("Set BPF Filter: ", err, PcapFilter)
 	} else {
+		if tee != nil {
+			if err := tee.start(config, handle.LinkType(), PcapFilter); err != nil {
+				log.Fatal("Capture Output: ", err)
+			}
+		}
 		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		packets := packetSource.Packets()
+		receiver := newReceiver(pcapChannel, sender, probes)
+		receiver.tee = tee
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 		setupChannel <- "setup"
-		for packet := range packetSource.Packets() {
-			parsedPacket := handlePacket(packet)
-			pcapChannel <- parsedPacket
+		for {
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					return
+				}
+				receiver.handlePacket(packet)
+			case now := <-ticker.C:
+				receiver.flush(now.Add(-time.Duration(config.Timeout) * time.Second))
+			}
+		}
+	}
+}
+
+// ReplayPCAP runs the packets of a capture file through a receiver, as if
+// they had been captured live, and closes results once every stream has
+// been parsed. Streams are timed out by the packets' timestamps rather than
+// the clock, and results finished together are sorted, so the same capture
+// always gives the same results in the same order.
+func ReplayPCAP(config Config, path string, results chan Result, validIP4 bool, validIP6 bool) error {
+	defer close(results)
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(BPFFilter(config, validIP4, validIP6)); err != nil {
+		return err
+	}
+
+	// Without a source address to filter on, the scanner's addresses are
+	// learned from the SYNs it sent and its own packets are skipped
+	var scanners map[string]struct{}
+	if config.SourceAddr4 == "" && config.SourceAddr6 == "" {
+		scanners = make(map[string]struct{})
+	}
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	receiver := newReceiver(results, nil, nil)
+	receiver.buffered = true
+	var lastFlush time.Time
+	for packet := range packetSource.Packets() {
+		if scanners != nil && fromScanner(packet, scanners) {
+			continue
+		}
+		receiver.handlePacket(packet)
+		timestamp := packet.Metadata().Timestamp
+		if timestamp.Sub(lastFlush) >= time.Second {
+			receiver.flush(timestamp.Add(-time.Duration(config.Timeout) * time.Second))
+			lastFlush = timestamp
 		}
+		receiver.release()
+	}
+	receiver.assembler.FlushAll()
+	receiver.release()
+	return nil
+}
+
+// fromScanner reports whether packet was sent by the scanner, adding the
+// source of every SYN without an ACK to scanners.
+func fromScanner(packet gopacket.Packet, scanners map[string]struct{}) bool {
+	ip, tcp := packetTCP(packet)
+	if tcp == nil {
+		return false
+	}
+	if tcp.SYN && !tcp.ACK {
+		scanners[ip.String()] = struct{}{}
 	}
+	_, ok := scanners[ip.String()]
+	return ok
 }
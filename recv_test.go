@@ -0,0 +1,156 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// replayRecord is the part of a replayed result the tests compare.
+type replayRecord struct {
+	target        string
+	module        string
+	versionString string
+	parseerror    bool
+}
+
+func replayFixture(t *testing.T, path string, config Config, validIP4 bool, validIP6 bool) []replayRecord {
+	t.Helper()
+	results := make(chan Result, 100)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ReplayPCAP(config, path, results, validIP4, validIP6)
+	}()
+
+	var records []replayRecord
+	for result := range results {
+		record := replayRecord{target: result.IPAddress + ":" + result.DstPort, module: result.Module}
+		if mysqlinformation, ok := result.Record.(MySQlInformation); ok {
+			record.versionString = mysqlinformation.VersionString
+			record.parseerror = mysqlinformation.Parseerror
+		}
+		records = append(records, record)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReplayPCAP: %v", err)
+	}
+	return records
+}
+
+// TestReplayPCAP replays testdata/replay.pcap, which holds a greeting split
+// over two segments, a server not speaking MySQL, and three streams cut off
+// partway through their greeting. The cut off streams are only parsed when
+// the capture ends, and must come out in the order they started.
+func TestReplayPCAP(t *testing.T) {
+	want := []replayRecord{
+		{target: "198.51.100.10:3306", module: "MySQL", versionString: "8.0.36"},
+		{target: "198.51.100.14:3306"},
+		{target: "198.51.100.13:3306", module: "MySQL", parseerror: true},
+		{target: "198.51.100.11:3306", module: "MySQL", parseerror: true},
+		{target: "198.51.100.12:3306", module: "MySQL", parseerror: true},
+	}
+	for run := 0; run < 10; run++ {
+		if got := replayFixture(t, "testdata/replay.pcap", Config{Timeout: 10, SourceAddr4: "192.0.2.1"}, true, false); !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: got %+v, want %+v", run, got, want)
+		}
+	}
+}
+
+// replaySegment is a TCP segment of a test capture, written as an Ethernet
+// frame.
+type replaySegment struct {
+	src, dst         string
+	srcPort, dstPort uint16
+	syn, ack         bool
+	payload          []byte
+}
+
+// writeReplayCapture writes segments to a pcap file, one millisecond apart.
+func writeReplayCapture(t *testing.T, segments []replaySegment) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	for i, segment := range segments {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(segment.src), DstIP: net.ParseIP(segment.dst)}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(segment.srcPort), DstPort: layers.TCPPort(segment.dstPort), Seq: 1000, SYN: segment.syn, ACK: segment.ack, Window: 65535}
+		if !segment.syn {
+			tcp.Seq = 1001
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(segment.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(buffer.Bytes()), Length: len(buffer.Bytes())}
+		if err := writer.WritePacket(info, buffer.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// TestReplayWithoutSourceAddress replays a capture holding both directions of
+// a connection without giving the scanner's address. The scanner's packets,
+// including its login after the greeting, must not be parsed as a server's.
+func TestReplayWithoutSourceAddress(t *testing.T) {
+	scanner, server := "198.51.100.1", "192.0.2.10"
+	path := writeReplayCapture(t, []replaySegment{
+		{src: scanner, dst: server, srcPort: 40000, dstPort: 3306, syn: true},
+		{src: server, dst: scanner, srcPort: 3306, dstPort: 40000, syn: true, ack: true},
+		{src: scanner, dst: server, srcPort: 40000, dstPort: 3306, ack: true},
+		{src: server, dst: scanner, srcPort: 3306, dstPort: 40000, ack: true, payload: testGreeting("caching_sha2_password", 0)},
+		{src: scanner, dst: server, srcPort: 40000, dstPort: 3306, ack: true, payload: append([]byte{32, 0, 0, 1}, strings.Repeat("x", 32)...)},
+	})
+
+	want := []replayRecord{{target: server + ":3306", module: "MySQL", versionString: "8.0.36"}}
+	if got := replayFixture(t, path, Config{Timeout: 10}, true, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBPFFilter(t *testing.T) {
+	filter := BPFFilter(Config{SourceAddr4: "192.0.2.1", SourceAddr6: "2001:db8::1"}, true, true)
+	if !strings.Contains(filter, "ip dst 192.0.2.1") || !strings.Contains(filter, "ip6 dst 2001:db8::1") {
+		t.Errorf("filter without the source addresses: %s", filter)
+	}
+	filter = BPFFilter(Config{}, true, true)
+	if strings.Contains(filter, "dst") || !strings.Contains(filter, "ip proto 6") || !strings.Contains(filter, "ip6 proto 6") {
+		t.Errorf("filter for replies to any address: %s", filter)
+	}
+}
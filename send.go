@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Some parts of this code is modified from:
+// LZR: https://github.com/stanford-esrg/lzr
+// ZMap: https://github.com/zmap/zmap
+
+package mysqlscanner
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Source ports for raw probes are chosen from the Linux ephemeral range.
+const (
+	rawSourcePortBase  = 32768
+	rawSourcePortRange = 28232
+)
+
+// RawSender writes crafted TCP packets directly to the interface, bypassing
+// the kernel's TCP stack. Like ZMap, it keeps no per-target state: the source
+// port and initial sequence number of every probe are derived from a secret
+// key and the target, so replies can be validated on receipt.
+type RawSender struct {
+	handle  *pcap.Handle
+	lock    sync.Mutex
+	srcMAC  net.HardwareAddr
+	dstMAC  net.HardwareAddr
+	source4 net.IP
+	source6 net.IP
+	secret  [16]byte
+	probes  *ProbeTable
+}
+
+func NewRawSender(config Config, probes *ProbeTable) (*RawSender, error) {
+	iface, err := net.InterfaceByName(config.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.HardwareAddr) == 0 {
+		return nil, errors.New("interface has no hardware address: " + config.Interface)
+	}
+	gatewayMAC, err := net.ParseMAC(config.GatewayMAC)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := pcap.OpenLive(config.Interface, 1600, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &RawSender{
+		handle:  handle,
+		srcMAC:  iface.HardwareAddr,
+		dstMAC:  gatewayMAC,
+		source4: net.ParseIP(config.SourceAddr4).To4(),
+		source6: net.ParseIP(config.SourceAddr6),
+		probes:  probes,
+	}
+	if _, err := rand.Read(sender.secret[:]); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return sender, nil
+}
+
+func (s *RawSender) Close() {
+	s.handle.Close()
+}
+
+// validation returns the source port and initial sequence number used for
+// probes to the given target.
+func (s *RawSender) validation(ip net.IP, port uint16) (uint16, uint32) {
+	hash := sha256.New()
+	hash.Write(s.secret[:])
+	hash.Write(ip.To16())
+	binary.Write(hash, binary.BigEndian, port)
+	sum := hash.Sum(nil)
+
+	srcPort := rawSourcePortBase + binary.BigEndian.Uint16(sum[0:2])%rawSourcePortRange
+	seq := binary.BigEndian.Uint32(sum[2:6])
+	return srcPort, seq
+}
+
+// SendSYN starts a TCP handshake with the target.
+func (s *RawSender) SendSYN(address string, port string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return errors.New("not a valid IP address: " + address)
+	}
+	dstPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	srcPort, seq := s.validation(ip, uint16(dstPort))
+	if s.probes != nil {
+		s.probes.addRaw(probeKey(ip, uint16(dstPort)), srcPort, seq)
+	}
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		SYN:     true,
+		Window:  65535,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}},
+	}
+	return s.send(ip, &tcp)
+}
+
+// handleControl processes handshake packets from probed targets. A valid
+// SYN-ACK is answered with an ACK so the server sends its greeting. It returns
+// true when the packet is a valid RST to a probe that has not had a SYN-ACK,
+// which is reported as a refused connection.
+func (s *RawSender) handleControl(packet gopacket.Packet) (Result, bool) {
+	ip, tcp := packetTCP(packet)
+	if tcp == nil || !(tcp.SYN || tcp.RST) {
+		return Result{}, false
+	}
+
+	srcPort, seq := s.validation(ip, uint16(tcp.SrcPort))
+	if uint16(tcp.DstPort) != srcPort {
+		return Result{}, false
+	}
+
+	if tcp.SYN && tcp.ACK && tcp.Ack == seq+1 {
+		ack := layers.TCP{
+			SrcPort: tcp.DstPort,
+			DstPort: tcp.SrcPort,
+			Seq:     seq + 1,
+			Ack:     tcp.Seq + 1,
+			ACK:     true,
+			Window:  65535,
+		}
+		s.send(ip, &ack)
+	} else if tcp.RST && (tcp.Seq == seq+1 || tcp.Ack == seq+1) {
+		// A reset after the SYN-ACK ends a connection that has already been
+		// recorded from its greeting stream
+		if s.probes != nil && s.probes.established(probeKey(ip, uint16(tcp.SrcPort))) {
+			return Result{}, false
+		}
+		return Result{IPAddress: ip.String(), DstPort: strconv.Itoa(int(tcp.SrcPort)), Errormessage: "connection refused"}, true
+	}
+	return Result{}, false
+}
+
+// reset closes a connection once its greeting has been read, as there is no
+// kernel socket to do so.
+func (s *RawSender) reset(ip net.IP, port uint16) {
+	srcPort, seq := s.validation(ip, port)
+	rst := layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(port),
+		Seq:     seq + 1,
+		RST:     true,
+	}
+	s.send(ip, &rst)
+}
+
+func (s *RawSender) send(dstIP net.IP, tcp *layers.TCP) error {
+	eth := layers.Ethernet{SrcMAC: s.srcMAC, DstMAC: s.dstMAC}
+	var network gopacket.SerializableLayer
+	if dstIP.To4() != nil {
+		if s.source4 == nil {
+			return errors.New("no IPv4 source address for " + dstIP.String())
+		}
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: s.source4, DstIP: dstIP.To4()}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		network = ip4
+	} else {
+		if s.source6 == nil {
+			return errors.New("no IPv6 source address for " + dstIP.String())
+		}
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: s.source6, DstIP: dstIP}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		network = ip6
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, &eth, network, tcp); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.handle.WritePacketData(buffer.Bytes())
+}
+
+// packetTCP returns the source address and TCP layer of a packet.
+func packetTCP(packet gopacket.Packet) (net.IP, *layers.TCP) {
+	var ip net.IP
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		ip = ip4.SrcIP
+	} else if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		ip = ip6.SrcIP
+	} else {
+		return nil, nil
+	}
+
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	return ip, tcp
+}
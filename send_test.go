@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"net"
+	"testing"
+)
+
+// TestHandleControl checks that a reset is only reported as a refused
+// connection before the target has answered the SYN.
+func TestHandleControl(t *testing.T) {
+	probes := NewProbeTable()
+	sender := &RawSender{probes: probes}
+	ip := net.ParseIP("192.0.2.1")
+	srcPort, seq := sender.validation(ip, 3306)
+
+	// Refused
+	probes.addRaw(testProbeKey, srcPort, seq)
+	rst := testSegment{dstPort: srcPort, ack: seq + 1, rst: true}.packet(t)
+	if !probes.validate(rst) {
+		t.Fatal("RST to the probe not matched")
+	}
+	result, refused := sender.handleControl(rst)
+	if !refused || result.IPAddress != "192.0.2.1" || result.DstPort != "3306" || result.Errormessage != "connection refused" {
+		t.Errorf("RST before SYN-ACK: got %+v, refused %v", result, refused)
+	}
+
+	// Reset after the greeting
+	probes.addRaw(testProbeKey, srcPort, seq)
+	synAck := testSegment{dstPort: srcPort, seq: 1000, ack: seq + 1, syn: true}.packet(t)
+	if !probes.validate(synAck) {
+		t.Fatal("SYN-ACK not matched")
+	}
+	if _, refused := sender.handleControl(synAck); refused {
+		t.Error("SYN-ACK reported as refused")
+	}
+	rst = testSegment{dstPort: srcPort, seq: 1100, ack: seq + 1, rst: true}.packet(t)
+	if !probes.validate(rst) {
+		t.Fatal("RST after SYN-ACK not matched")
+	}
+	if result, refused := sender.handleControl(rst); refused {
+		t.Errorf("RST after SYN-ACK reported as refused: %+v", result)
+	}
+}
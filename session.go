@@ -0,0 +1,103 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// maxPacketLength bounds the MySQL packets a session will read.
+const maxPacketLength = 1 << 20
+
+// Session is an open MySQL connection on which the scanner continues the
+// handshake after the greeting, e.g. to upgrade to TLS. Packets are read and
+// written with the 4-byte MySQL header, and the sequence number is tracked
+// across calls.
+type Session struct {
+	Conn     net.Conn
+	Timeout  time.Duration
+	sequence byte
+	tls      bool
+}
+
+func NewSession(conn net.Conn, timeout time.Duration) *Session {
+	return &Session{Conn: conn, Timeout: timeout}
+}
+
+// ReadPacket reads one MySQL packet, including its header, so that it can be
+// handed to ParseMySQL and ParseMySQLError as-is.
+func (s *Session) ReadPacket() ([]byte, error) {
+	s.Conn.SetReadDeadline(time.Now().Add(s.Timeout))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(s.Conn, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length > maxPacketLength {
+		return nil, errors.New("packet too large")
+	}
+	packet := make([]byte, 4+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(s.Conn, packet[4:]); err != nil {
+		return nil, err
+	}
+	s.sequence = header[3] + 1
+	return packet, nil
+}
+
+// WritePacket writes payload with a MySQL header carrying the next sequence
+// number.
+func (s *Session) WritePacket(payload []byte) error {
+	packet := make([]byte, 4+len(payload))
+	packet[0] = byte(len(payload))
+	packet[1] = byte(len(payload) >> 8)
+	packet[2] = byte(len(payload) >> 16)
+	packet[3] = s.sequence
+	copy(packet[4:], payload)
+
+	s.Conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	if _, err := s.Conn.Write(packet); err != nil {
+		return err
+	}
+	s.sequence++
+	return nil
+}
+
+// ResumeGreeting parses a greeting packet that was already read from the
+// connection, continuing the session after it.
+func (s *Session) ResumeGreeting(packet []byte) (MySQlInformation, error) {
+	if len(packet) < 4 {
+		return MySQlInformation{Issql: false}, ErrNotMySQL
+	}
+	s.sequence = packet[3] + 1
+	return ParseGreeting(packet)
+}
+
+// ReadGreeting reads and parses the server's initial handshake. When the
+// greeting was already captured by the PCAP listener, this consumes the same
+// bytes from the socket so the session can continue from them.
+func (s *Session) ReadGreeting() (MySQlInformation, error) {
+	packet, err := s.ReadPacket()
+	if err != nil {
+		return MySQlInformation{Issql: false}, err
+	}
+	return ParseGreeting(packet)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer is the server end of a connection to a MySQL stand-in.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// readPacket reads a packet from the client, checking its sequence number.
+func (f fakeServer) readPacket(sequence byte) []byte {
+	f.t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f.conn, header); err != nil {
+		f.t.Errorf("fake server read: %v", err)
+		return nil
+	}
+	if header[3] != sequence {
+		f.t.Errorf("fake server read sequence %d, want %d", header[3], sequence)
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(f.conn, payload); err != nil {
+		f.t.Errorf("fake server read: %v", err)
+	}
+	return payload
+}
+
+func (f fakeServer) writePacket(sequence byte, payload []byte) {
+	f.t.Helper()
+	packet := append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequence}, payload...)
+	if _, err := f.conn.Write(packet); err != nil {
+		f.t.Errorf("fake server write: %v", err)
+	}
+}
+
+// handshakeResponseFields splits a HandshakeResponse41 into its username,
+// authentication response and plugin.
+func handshakeResponseFields(t *testing.T, payload []byte) (string, []byte, string) {
+	t.Helper()
+	fields := payload[32:]
+	end := bytes.IndexByte(fields, 0)
+	if end < 0 || end+2 > len(fields) {
+		t.Fatalf("malformed handshake response %x", payload)
+	}
+	username := string(fields[:end])
+	length := int(fields[end+1])
+	response := fields[end+2 : end+2+length]
+	plugin := string(bytes.TrimRight(fields[end+2+length:], "\x00"))
+	return username, response, plugin
+}
+
+// pipeSession starts serve on one end of a pipe and returns a session on the
+// other, positioned after a greeting with sequence number 0. The test waits
+// for serve to return.
+func pipeSession(t *testing.T, serve func(server fakeServer)) *Session {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		serve(fakeServer{t: t, conn: server})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	session := NewSession(client, 2*time.Second)
+	session.sequence = 1
+	return session
+}
+
+var (
+	okPacket     = []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+	accessDenied = append([]byte{0xff, 0x15, 0x04}, "#28000Access denied for user"...)
+)
+
+// testSalt is the 20 byte scramble sent in test greetings.
+var testSalt = []byte("abcdefghijklmnopqrst")
+
+// testGreeting builds a Handshake v10 packet from a MySQL 8.0 server using
+// plugin, with capabilities the extra capability flags to advertise.
+func testGreeting(plugin string, capabilities uint32) []byte {
+	capabilities |= 0x000fa20d // PROTOCOL_41, SECURE_CONNECTION, PLUGIN_AUTH and others
+	payload := []byte{0x0a}
+	payload = append(payload, "8.0.36\x00"...)
+	payload = binary.LittleEndian.AppendUint32(payload, 42)
+	payload = append(payload, testSalt[:8]...)
+	payload = append(payload, 0)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(capabilities))
+	payload = append(payload, 0xff)
+	payload = binary.LittleEndian.AppendUint16(payload, 0x0002)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(capabilities>>16))
+	payload = append(payload, 21)
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, testSalt[8:]...)
+	payload = append(payload, 0)
+	payload = append(payload, plugin...)
+	payload = append(payload, 0)
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), 0, 0}, payload...)
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports from the input.
+type portRange struct {
+	first int
+	last  int
+}
+
+// TargetLine is one input line: a single address, a CIDR prefix or an
+// address range, a list of ports and port ranges, and optionally the name of
+// the module to probe with. Its targets are generated one at a time, so that
+// large prefixes are never held in memory.
+type TargetLine struct {
+	Module string
+	first  *big.Int
+	ipv4   bool
+	ports  []portRange
+	count  *big.Int
+	total  *big.Int
+
+	// Position of the generator, and the LCG it steps with when randomised
+	index      *big.Int
+	emitted    *big.Int
+	modulus    *big.Int
+	multiplier *big.Int
+	increment  *big.Int
+}
+
+// ParseTargetLine parses an input line such as 192.0.2.0/24,3306,
+// 192.0.2.1-192.0.2.50,3306,33060-33062,mysql or 2001:db8::/120,3306. When
+// randomize is set the line's targets are generated in a random order.
+func ParseTargetLine(line string, randomize bool) (*TargetLine, error) {
+	parts := strings.Split(strings.TrimSpace(line), ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 2 {
+		return nil, errors.New("no port given")
+	}
+
+	// The last column names the module if it is not a port
+	targetLine := &TargetLine{}
+	if len(parts) >= 3 {
+		if _, err := parsePortRange(parts[len(parts)-1]); err != nil {
+			targetLine.Module = parts[len(parts)-1]
+			parts = parts[:len(parts)-1]
+			if _, ok := LookupModule(targetLine.Module); !ok {
+				return nil, errors.New("not a valid module: " + targetLine.Module)
+			}
+		}
+	}
+
+	// Add Addresses
+	first, last, err := parseAddressRange(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	targetLine.ipv4 = first.To4() != nil
+	targetLine.first = addressInt(first)
+	addresses := new(big.Int).Sub(addressInt(last), targetLine.first)
+	addresses.Add(addresses, big.NewInt(1))
+
+	// Add Ports
+	portCount := 0
+	for _, part := range parts[1:] {
+		ports, err := parsePortRange(part)
+		if err != nil {
+			return nil, err
+		}
+		targetLine.ports = append(targetLine.ports, ports)
+		portCount += ports.last - ports.first + 1
+	}
+	targetLine.count = big.NewInt(int64(portCount))
+	targetLine.total = new(big.Int).Mul(addresses, targetLine.count)
+
+	targetLine.index = new(big.Int)
+	targetLine.emitted = new(big.Int)
+	if randomize {
+		if err := targetLine.randomize(); err != nil {
+			return nil, err
+		}
+	}
+	return targetLine, nil
+}
+
+// IPv4 reports whether the line's addresses are IPv4 addresses.
+func (t *TargetLine) IPv4() bool {
+	return t.ipv4
+}
+
+// Next returns the line's next target, or false once every target has been
+// generated.
+func (t *TargetLine) Next() (net.IP, string, bool) {
+	if t.emitted.Cmp(t.total) >= 0 {
+		return nil, "", false
+	}
+	index := new(big.Int).Set(t.index)
+	if t.modulus == nil {
+		t.index.Add(t.index, big.NewInt(1))
+	} else {
+		// Values past the end of the line are skipped
+		for index.Cmp(t.total) >= 0 {
+			index = t.step(index)
+		}
+		t.index = t.step(index)
+	}
+	t.emitted.Add(t.emitted, big.NewInt(1))
+
+	// Each address is paired with every port in turn
+	address, port := new(big.Int).DivMod(index, t.count, new(big.Int))
+	address.Add(address, t.first)
+	offset := int(port.Int64())
+	for _, ports := range t.ports {
+		if offset <= ports.last-ports.first {
+			return intAddress(address, t.ipv4), strconv.Itoa(ports.first + offset), true
+		}
+		offset -= ports.last - ports.first + 1
+	}
+	return nil, "", false
+}
+
+// TargetSet generates the targets of several input lines. When randomized,
+// each target is taken from a line picked at random among those with targets
+// left, so that the lines of a file are probed together rather than one after
+// another. Lines with fewer targets are finished sooner.
+type TargetSet struct {
+	lines     []*TargetLine
+	randomize bool
+}
+
+// NewTargetSet returns an empty set. Without randomize, lines are generated
+// in the order they were added.
+func NewTargetSet(randomize bool) *TargetSet {
+	return &TargetSet{randomize: randomize}
+}
+
+// Add queues a line's targets.
+func (s *TargetSet) Add(line *TargetLine) {
+	s.lines = append(s.lines, line)
+}
+
+// Next returns the next target and the line it belongs to, or false once every
+// line has been exhausted.
+func (s *TargetSet) Next() (*TargetLine, net.IP, string, bool) {
+	for len(s.lines) > 0 {
+		i := 0
+		if s.randomize {
+			i = mathrand.IntN(len(s.lines))
+		}
+		line := s.lines[i]
+		if ipaddress, port, ok := line.Next(); ok {
+			return line, ipaddress, port, true
+		}
+		if s.randomize {
+			s.lines[i] = s.lines[len(s.lines)-1]
+			s.lines = s.lines[:len(s.lines)-1]
+		} else {
+			s.lines = s.lines[1:]
+		}
+	}
+	return nil, nil, "", false
+}
+
+// randomize sets up a full period linear congruential generator over the
+// smallest power of two covering the line's targets. By the Hull-Dobell
+// theorem a multiplier of 1 mod 4 and an odd increment visit every value
+// once, and fewer than half of them fall past the end to be skipped.
+func (t *TargetLine) randomize() error {
+	t.modulus = new(big.Int).Lsh(big.NewInt(1), uint(new(big.Int).Sub(t.total, big.NewInt(1)).BitLen()))
+	var err error
+	if t.multiplier, err = rand.Int(rand.Reader, t.modulus); err != nil {
+		return err
+	}
+	t.multiplier.Lsh(t.multiplier, 2).Add(t.multiplier, big.NewInt(1)).Mod(t.multiplier, t.modulus)
+	if t.increment, err = rand.Int(rand.Reader, t.modulus); err != nil {
+		return err
+	}
+	t.increment.SetBit(t.increment, 0, 1).Mod(t.increment, t.modulus)
+	if t.index, err = rand.Int(rand.Reader, t.modulus); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *TargetLine) step(index *big.Int) *big.Int {
+	next := new(big.Int).Mul(index, t.multiplier)
+	next.Add(next, t.increment)
+	return next.Mod(next, t.modulus)
+}
+
+// parseAddressRange parses a single address, a CIDR prefix or a range of two
+// addresses separated by a dash into its first and last addresses.
+func parseAddressRange(field string) (net.IP, net.IP, error) {
+	if strings.Contains(field, "/") {
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, nil, err
+		}
+		last := make(net.IP, len(network.IP))
+		for i := range network.IP {
+			last[i] = network.IP[i] | ^network.Mask[i]
+		}
+		return network.IP, last, nil
+	}
+
+	bounds := strings.SplitN(field, "-", 2)
+	first := parseAddress(bounds[0])
+	last := first
+	if len(bounds) == 2 {
+		last = parseAddress(bounds[1])
+	}
+	if first == nil || last == nil {
+		return nil, nil, errors.New("not a valid IP address: " + field)
+	}
+	if len(first) != len(last) {
+		return nil, nil, errors.New("range mixes IPv4 and IPv6 addresses: " + field)
+	}
+	if addressInt(first).Cmp(addressInt(last)) > 0 {
+		return nil, nil, errors.New("range ends before it starts: " + field)
+	}
+	return first, last, nil
+}
+
+// parseAddress parses an address, in its 4 byte form if it is IPv4.
+func parseAddress(field string) net.IP {
+	ipaddress := net.ParseIP(strings.TrimSpace(field))
+	if ipv4 := ipaddress.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return ipaddress
+}
+
+// parsePortRange parses a port or a range of ports separated by a dash.
+func parsePortRange(field string) (portRange, error) {
+	bounds := strings.SplitN(field, "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return portRange{}, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(bounds[1]); err != nil {
+			return portRange{}, err
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return portRange{}, fmt.Errorf("not a valid port range: %s", field)
+	}
+	return portRange{first: first, last: last}, nil
+}
+
+func addressInt(ipaddress net.IP) *big.Int {
+	return new(big.Int).SetBytes(ipaddress)
+}
+
+func intAddress(value *big.Int, ipv4 bool) net.IP {
+	size := net.IPv6len
+	if ipv4 {
+		size = net.IPv4len
+	}
+	return net.IP(value.FillBytes(make([]byte, size)))
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"testing"
+)
+
+// lineTargets drains a line, returning its targets as address:port strings.
+func lineTargets(t *testing.T, line *TargetLine) []string {
+	t.Helper()
+	var targets []string
+	for {
+		ipaddress, port, ok := line.Next()
+		if !ok {
+			return targets
+		}
+		targets = append(targets, net.JoinHostPort(ipaddress.String(), port))
+	}
+}
+
+func TestParseTargetLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		module  string
+		targets []string
+	}{
+		{"192.0.2.1,3306", "", []string{"192.0.2.1:3306"}},
+		{"192.0.2.1/32,3306", "", []string{"192.0.2.1:3306"}},
+		{"2001:db8::1/128,3306", "", []string{"[2001:db8::1]:3306"}},
+		{"10.0.0.0/30,3306", "", []string{"10.0.0.0:3306", "10.0.0.1:3306", "10.0.0.2:3306", "10.0.0.3:3306"}},
+		{"10.0.0.1/30,3306", "", []string{"10.0.0.0:3306", "10.0.0.1:3306", "10.0.0.2:3306", "10.0.0.3:3306"}},
+		{"192.0.2.1-192.0.2.2,3306,33060-33061", "", []string{
+			"192.0.2.1:3306", "192.0.2.1:33060", "192.0.2.1:33061",
+			"192.0.2.2:3306", "192.0.2.2:33060", "192.0.2.2:33061",
+		}},
+		{"192.0.2.1-192.0.2.1,3306", "", []string{"192.0.2.1:3306"}},
+		{"2001:db8::/127,5432", "", []string{"[2001:db8::]:5432", "[2001:db8::1]:5432"}},
+		{"192.0.2.255-192.0.3.0,1,65535", "", []string{"192.0.2.255:1", "192.0.2.255:65535", "192.0.3.0:1", "192.0.3.0:65535"}},
+		{" 192.0.2.1 , 3306 , 3307 , XProtocol ", "XProtocol", []string{"192.0.2.1:3306", "192.0.2.1:3307"}},
+	}
+	for _, test := range tests {
+		line, err := ParseTargetLine(test.line, false)
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+		if line.Module != test.module {
+			t.Errorf("%q: module %q, want %q", test.line, line.Module, test.module)
+		}
+		if got := lineTargets(t, line); fmt.Sprint(got) != fmt.Sprint(test.targets) {
+			t.Errorf("%q: targets %v, want %v", test.line, got, test.targets)
+		}
+	}
+}
+
+func TestParseTargetLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"192.0.2.1",
+		"192.0.2.1,",
+		"192.0.2.3-192.0.2.1,3306",
+		"2001:db8::2-2001:db8::1,3306",
+		"192.0.2.1-2001:db8::1,3306",
+		"192.0.2.0/33,3306",
+		"2001:db8::/129,3306",
+		"192.0.2.256,3306",
+		"example.com,3306",
+		"192.0.2.1,0",
+		"192.0.2.1,65536",
+		"192.0.2.1,3307-3306",
+		"192.0.2.1,3306,oracle",
+	} {
+		if _, err := ParseTargetLine(line, false); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+// A prefix wider than 64 bits is counted and walked without overflowing.
+func TestParseTargetLineWideRange(t *testing.T) {
+	line, err := ParseTargetLine("2001:db8::/63,3306,3307", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Lsh(big.NewInt(1), 66)
+	if line.total.Cmp(want) != 0 {
+		t.Errorf("total %s, want %s", line.total, want)
+	}
+	first, last, err := parseAddressRange("2001:db8::/63")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != "2001:db8::" || last.String() != "2001:db8:0:1:ffff:ffff:ffff:ffff" {
+		t.Errorf("range %s-%s", first, last)
+	}
+	prefix := &net.IPNet{IP: first, Mask: net.CIDRMask(63, 128)}
+	for i := 0; i < 1000; i++ {
+		ipaddress, port, ok := line.Next()
+		if !ok {
+			t.Fatal("line exhausted")
+		}
+		if !prefix.Contains(ipaddress) || (port != "3306" && port != "3307") {
+			t.Fatalf("target %s port %s outside the line", ipaddress, port)
+		}
+	}
+}
+
+// The randomised generator visits every target of a line exactly once.
+func TestParseTargetLineRandomize(t *testing.T) {
+	for _, line := range []string{
+		"192.0.2.1,3306",
+		"192.0.2.1,3306,3307",
+		"192.0.2.1-192.0.2.3,3306",
+		"192.0.2.1-192.0.2.5,3306",
+		"192.0.2.0/28,3306",
+		"192.0.2.1-192.0.2.17,3306",
+		"10.0.0.0/24,3306",
+		"10.0.0.0/22,3306",
+		"10.0.0.0-10.0.3.231,3306",
+		"2001:db8::/120,3306,33060-33062",
+	} {
+		ordered, err := ParseTargetLine(line, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := lineTargets(t, ordered)
+		for run := 0; run < 5; run++ {
+			randomized, err := ParseTargetLine(line, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := lineTargets(t, randomized)
+			sort.Strings(got)
+			sorted := append([]string(nil), want...)
+			sort.Strings(sorted)
+			if fmt.Sprint(got) != fmt.Sprint(sorted) {
+				t.Fatalf("%q: randomised targets differ from the line's %d targets, got %d", line, len(want), len(got))
+			}
+		}
+	}
+}
+
+func TestTargetSet(t *testing.T) {
+	lines := []string{"192.0.2.0/30,3306", "198.51.100.1,5432,postgresql", "203.0.113.0/29,3306"}
+	for _, randomize := range []bool{false, true} {
+		set := NewTargetSet(randomize)
+		var want []string
+		for _, text := range lines {
+			line, err := ParseTargetLine(text, randomize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			set.Add(line)
+			ordered, _ := ParseTargetLine(text, false)
+			want = append(want, lineTargets(t, ordered)...)
+		}
+		var got []string
+		for {
+			line, ipaddress, port, ok := set.Next()
+			if !ok {
+				break
+			}
+			if ipaddress.String() == "198.51.100.1" && line.Module != "postgresql" {
+				t.Errorf("target %s returned with line module %q", ipaddress, line.Module)
+			}
+			got = append(got, net.JoinHostPort(ipaddress.String(), port))
+		}
+		if !randomize {
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("targets %v, want %v", got, want)
+			}
+			continue
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("randomised targets %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client capability flags sent in the SSLRequest.
+const (
+	clientLongPassword     = 0x00000001
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+)
+
+// serverHelloLimit bounds how much of the server's side of the TLS handshake
+// is kept to find the ServerHello.
+const serverHelloLimit = 16384
+
+type TLSCertificate struct {
+	Subject           string
+	Issuer            string
+	SerialNumber      string
+	NotBefore         time.Time
+	NotAfter          time.Time
+	DNSNames          []string
+	SHA256Fingerprint string
+	Raw               []byte
+}
+
+// TLSInformation describes the TLS session negotiated after an SSLRequest.
+// SNIAcknowledged is only observable up to TLS 1.2, as TLS 1.3 servers
+// acknowledge the server name in their encrypted extensions.
+type TLSInformation struct {
+	Version         string
+	CipherSuite     string
+	ServerName      string
+	SNIAcknowledged bool
+	Certificates    []TLSCertificate
+	JA3S            string
+	JA3SString      string
+	Errormessage    string
+}
+
+// recordingConn keeps a copy of the first bytes read from a connection.
+type recordingConn struct {
+	net.Conn
+	recorded []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if len(c.recorded) < serverHelloLimit {
+		c.recorded = append(c.recorded, b[:n]...)
+	}
+	return n, err
+}
+
+// StartTLS sends an SSLRequest and upgrades the session to TLS. The server
+// certificates are not verified, as the goal is to record them. On success,
+// the session continues over the TLS connection.
+func (s *Session) StartTLS(serverName string) (*TLSInformation, error) {
+	tlsinformation := &TLSInformation{ServerName: serverName}
+
+	// Send SSLRequest
+	request := make([]byte, 32)
+	binary.LittleEndian.PutUint32(request[0:4], clientLongPassword|clientProtocol41|clientSSL|clientSecureConnection|clientPluginAuth)
+	binary.LittleEndian.PutUint32(request[4:8], maxPacketLength)
+	request[8] = 0x21
+	if err := s.WritePacket(request); err != nil {
+		return tlsinformation, err
+	}
+
+	tlsConn, err := tlsClient(s.Conn, serverName, s.Timeout, tlsinformation)
+	if err != nil {
+		return tlsinformation, err
+	}
+	s.Conn = tlsConn
+	s.tls = true
+	return tlsinformation, nil
+}
+
+// tlsClient completes a TLS handshake on conn and records it in
+// tlsinformation. The server certificates are not verified.
+func tlsClient(conn net.Conn, serverName string, timeout time.Duration, tlsinformation *TLSInformation) (*tls.Conn, error) {
+	// Offer every cipher suite so that older servers can still be recorded
+	var cipherSuites []uint16
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		cipherSuites = append(cipherSuites, suite.ID)
+	}
+
+	recorder := &recordingConn{Conn: conn}
+	tlsConn := tls.Client(recorder, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       cipherSuites,
+	})
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	err := tlsConn.Handshake()
+	parseServerHello(recorder.recorded, tlsinformation)
+	if err != nil {
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	tlsinformation.Version = tls.VersionName(state.Version)
+	tlsinformation.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	for _, certificate := range state.PeerCertificates {
+		fingerprint := sha256.Sum256(certificate.Raw)
+		tlsinformation.Certificates = append(tlsinformation.Certificates, TLSCertificate{
+			Subject:           certificate.Subject.String(),
+			Issuer:            certificate.Issuer.String(),
+			SerialNumber:      certificate.SerialNumber.String(),
+			NotBefore:         certificate.NotBefore,
+			NotAfter:          certificate.NotAfter,
+			DNSNames:          certificate.DNSNames,
+			SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Raw:               certificate.Raw,
+		})
+	}
+	return tlsConn, nil
+}
+
+// parseServerHello finds the ServerHello in the raw bytes received during the
+// TLS handshake and records its JA3S fingerprint and whether the server_name
+// extension was echoed.
+func parseServerHello(recorded []byte, tlsinformation *TLSInformation) {
+	// Reassemble handshake messages from the TLS records
+	var handshake []byte
+	for len(recorded) >= 5 && recorded[0] == 0x16 {
+		length := int(binary.BigEndian.Uint16(recorded[3:5]))
+		if len(recorded) < 5+length {
+			break
+		}
+		handshake = append(handshake, recorded[5:5+length]...)
+		recorded = recorded[5+length:]
+	}
+
+	if len(handshake) < 4 || handshake[0] != 0x02 {
+		return
+	}
+	length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+	if len(handshake) < 4+length {
+		return
+	}
+	reader := payloadReader{payload: handshake[4 : 4+length]}
+
+	// Version, Random and Session ID
+	version, err := reader.next(2)
+	if err != nil {
+		return
+	}
+	if _, err = reader.next(32); err != nil {
+		return
+	}
+	sessionIDLength, err := reader.readByte()
+	if err != nil {
+		return
+	}
+	if _, err = reader.next(int(sessionIDLength)); err != nil {
+		return
+	}
+
+	// Cipher Suite and Compression Method
+	cipher, err := reader.next(2)
+	if err != nil {
+		return
+	}
+	if _, err = reader.next(1); err != nil {
+		return
+	}
+
+	// Extensions
+	var extensions []string
+	extensionsLength, err := reader.next(2)
+	if err == nil {
+		extensionData, _ := reader.next(int(binary.BigEndian.Uint16(extensionsLength)))
+		for len(extensionData) >= 4 {
+			extension := binary.BigEndian.Uint16(extensionData[0:2])
+			extensionLength := int(binary.BigEndian.Uint16(extensionData[2:4]))
+			if len(extensionData) < 4+extensionLength {
+				break
+			}
+			if extension == 0 {
+				tlsinformation.SNIAcknowledged = true
+			}
+			extensions = append(extensions, strconv.Itoa(int(extension)))
+			extensionData = extensionData[4+extensionLength:]
+		}
+	}
+
+	tlsinformation.JA3SString = strconv.Itoa(int(binary.BigEndian.Uint16(version))) + "," + strconv.Itoa(int(binary.BigEndian.Uint16(cipher))) + "," + strings.Join(extensions, "-")
+	ja3s := md5.Sum([]byte(tlsinformation.JA3SString))
+	tlsinformation.JA3S = hex.EncodeToString(ja3s[:])
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientSSLCapability is CLIENT_SSL, advertised by servers that accept an
+// SSLRequest.
+const clientSSLCapability = 1 << 11
+
+// testCertificate returns a self-signed certificate for the fake server.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mysql.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// readSSLRequest reads the client's SSLRequest and checks it asks for TLS.
+func (f fakeServer) readSSLRequest() {
+	f.t.Helper()
+	request := f.readPacket(1)
+	if len(request) != 32 || binary.LittleEndian.Uint32(request)&clientSSLCapability == 0 {
+		f.t.Errorf("got SSLRequest %x", request)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	certificate := testCertificate(t)
+	session := pipeSession(t, func(server fakeServer) {
+		server.readSSLRequest()
+		tlsConn := tls.Server(server.conn, &tls.Config{Certificates: []tls.Certificate{certificate}})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("server handshake: %v", err)
+		}
+	})
+
+	tlsinformation, err := session.StartTLS("mysql.example")
+	if err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if !session.tls {
+		t.Error("session not marked as TLS")
+	}
+	if tlsinformation.Version == "" || tlsinformation.CipherSuite == "" {
+		t.Errorf("got version %q and cipher suite %q", tlsinformation.Version, tlsinformation.CipherSuite)
+	}
+	if len(tlsinformation.Certificates) != 1 {
+		t.Errorf("got %d certificates, want 1", len(tlsinformation.Certificates))
+	}
+}
+
+// TestRunTLSFailure checks that a failed TLS upgrade is recorded and that no
+// credentials are then sent over a plaintext reconnect.
+func TestRunTLSFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// The connection advertises SSL but is not a TLS server
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		server := fakeServer{t: t, conn: conn}
+		conn.Write(testGreeting("mysql_native_password", clientSSLCapability))
+		server.readSSLRequest()
+		conn.Write([]byte("not a TLS record"))
+		conn.Close()
+
+		if conn, err := listener.Accept(); err == nil {
+			t.Error("reconnected after the TLS upgrade failed")
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prober := &ActiveProber{
+		config:      Config{Timeout: 2, TLS: true, CheckAnonymous: true},
+		credentials: []Credential{{Username: "root", Password: "secret"}},
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	mysqlinformation := MySQlInformation{IPAddress: host, DstPort: port, AuthenticationPlugin: "mysql_native_password"}
+	mysqlinformation.ServerCapabilities.SWITCHTOSSLAFTERHANDSHAKE = true
+
+	mysqlinformation = prober.Run(conn, mysqlinformation, nil)
+	listener.Close()
+	<-done
+
+	if mysqlinformation.TLS == nil || mysqlinformation.TLS.Errormessage == "" {
+		t.Errorf("failed TLS upgrade not recorded: %+v", mysqlinformation.TLS)
+	}
+	if anonymous := mysqlinformation.Anonymous; anonymous == nil || anonymous.Errormessage == "" || len(anonymous.Attempts) != 0 {
+		t.Errorf("anonymous logins not skipped: %+v", anonymous)
+	}
+	if len(mysqlinformation.Authentication) != 1 || mysqlinformation.Authentication[0].Errormessage == "" {
+		t.Errorf("credential not skipped: %+v", mysqlinformation.Authentication)
+	}
+}
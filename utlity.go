@@ -21,16 +21,17 @@ package mysqlscanner
 
 import (
 	"net"
-	"strings"
+	"strconv"
 
 	flags "github.com/jessevdk/go-flags"
-	log "github.com/sirupsen/logrus"
 )
 
 var parser *flags.Parser
 
 func init() {
 	parser = flags.NewParser(&config, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("replay", "Re-parse an archived capture", "Runs the packets of a pcap or pcapng file through the receiver and writes the same records as a scan.", &replayOptions)
 }
 
 func ParseCommandLine(args []string) ([]string, Config, error) {
@@ -38,46 +39,30 @@ func ParseCommandLine(args []string) ([]string, Config, error) {
 	return posArgs, config, err
 }
 
-func ParseNetStringAndIP(config Config, ipstring string, validIP4 bool, validIP6 bool) (string, string, string, string) {
-	// Split string
-	parts := strings.Split(ipstring, ",")
-
-	if len(parts) < 2 {
-		log.Errorf("Not a Valid IP/Port pair: %s", ipstring)
-		return "", "", "", ""
-	}
-
-	// Create formatted string
-	ipaddress := net.ParseIP(parts[0])
-	if ipaddress == nil {
-		log.Errorf("Not a Valid IP/Port pair: %s", ipstring)
-		return "", "", "", ""
-	}
-
-	// Check IPv4 vs. IPv6 format.
-	var ipaddressString string
-	var networkString string
-	if ipaddress.To4() != nil && validIP4 == true {
-		ipaddressString = ipaddress.String() //+ ":" + strings.TrimRight(parts[1], "\n")
-		networkString = "tcp4"
-	} else if ipaddress.To4() == nil && validIP6 == true {
-		ipaddressString = "[" + ipaddress.String() + "]" //+ ":" + strings.TrimRight(parts[1], "\n")
-		networkString = "tcp6"
-	} else {
-		log.Error("Correct Interface not specified.")
-		return "", "", "", ""
+// ReplayRequested returns the replay command's options if the command was
+// given on the command line.
+func ReplayRequested() (ReplayOptions, bool) {
+	return replayOptions, parser.Active != nil && parser.Active.Name == "replay"
+}
 
+// NetString formats a target address for dialing, and returns it with the
+// network to dial and the local address to dial from.
+func NetString(config Config, ipaddress net.IP) (string, string, string) {
+	if ipaddress.To4() != nil {
+		return ipaddress.String(), "tcp4", config.SourceAddr4
 	}
+	return "[" + ipaddress.String() + "]", "tcp6", config.SourceAddr6
+}
 
-	// Get formatted string and port for ConnectTCP
-	inputLocalAddress := ""
-	if networkString == "tcp4" {
-		inputLocalAddress = config.SourceAddr4
-	} else {
-		inputLocalAddress = config.SourceAddr6
+// ParseModule returns the module to probe a target with: the one named in
+// its input line if given, and otherwise the default for its port. It
+// returns nil for an unknown module.
+func ParseModule(name string, port string) Module {
+	if name != "" {
+		module, _ := LookupModule(name)
+		return module
 	}
 
-	port := strings.TrimRight(parts[1], "\n")
-
-	return ipaddressString, port, networkString, inputLocalAddress
+	portNumber, _ := strconv.Atoi(port)
+	return ModuleForPort(portNumber)
 }
@@ -0,0 +1,397 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlscanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// X Protocol message types.
+const (
+	xClientCapabilitiesGet = 1
+	xServerError           = 1
+	xServerCapabilities    = 2
+	xServerNotice          = 11
+)
+
+// xNoticeLimit bounds the notices skipped while waiting for the reply.
+const xNoticeLimit = 16
+
+// XProtocolInformation is the reply of a MySQL X Protocol server to
+// CapabilitiesGet. Capabilities holds every capability decoded to plain JSON
+// values, and the well-known ones are also given their own fields.
+type XProtocolInformation struct {
+	IPAddress                string
+	DstPort                  string
+	IsXProtocol              bool
+	TLS                      bool
+	AuthenticationMechanisms []string
+	DocFormats               string
+	CompressionAlgorithms    []string
+	NodeType                 string
+	ClientInteractive        bool
+	Capabilities             map[string]interface{}
+	Errorcode                uint16 `json:",omitempty"`
+	SQLState                 string `json:",omitempty"`
+	Errormessage             string `json:",omitempty"`
+}
+
+func init() {
+	RegisterModule(xprotocolModule{}, 33060)
+}
+
+// xprotocolModule probes the X Protocol. Unlike the classic protocol, the
+// client speaks first, so the probe runs directly on the connection.
+type xprotocolModule struct{}
+
+func (xprotocolModule) Name() string {
+	return "XProtocol"
+}
+
+func (xprotocolModule) BPFFragment() string {
+	return ""
+}
+
+// Match checks that payload starts with an X Protocol frame of a type the
+// server sends in reply to CapabilitiesGet.
+func (xprotocolModule) Match(payload []byte) (int, bool) {
+	if len(payload) < 5 {
+		return 0, true
+	}
+	length := binary.LittleEndian.Uint32(payload[0:4])
+	switch payload[4] {
+	case xServerError, xServerCapabilities, xServerNotice:
+		return 4 + int(length), length > 0 && length <= maxPacketLength
+	}
+	return 0, false
+}
+
+func (xprotocolModule) Parse(payload []byte) interface{} {
+	return readXCapabilities(bytes.NewReader(payload))
+}
+
+// Probe sends CapabilitiesGet on conn and decodes the reply.
+func (xprotocolModule) Probe(conn net.Conn, config Config) interface{} {
+	xinformation := XProtocolInformation{}
+	conn.SetDeadline(time.Now().Add(time.Duration(config.Timeout) * time.Second))
+	if _, err := conn.Write([]byte{1, 0, 0, 0, xClientCapabilitiesGet}); err != nil {
+		xinformation.Errormessage = err.Error()
+	} else {
+		xinformation = readXCapabilities(conn)
+	}
+	if address, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		xinformation.IPAddress = address.IP.String()
+		xinformation.DstPort = strconv.Itoa(address.Port)
+	}
+	return xinformation
+}
+
+// readXCapabilities reads the server's reply to CapabilitiesGet, skipping
+// any notices sent before it.
+func readXCapabilities(reader io.Reader) XProtocolInformation {
+	xinformation := XProtocolInformation{}
+	for notices := 0; notices <= xNoticeLimit; notices++ {
+		messageType, message, err := readXMessage(reader)
+		if err != nil {
+			xinformation.Errormessage = err.Error()
+			return xinformation
+		}
+
+		switch messageType {
+		case xServerNotice:
+			continue
+		case xServerCapabilities:
+			err = parseXCapabilities(message, &xinformation)
+		case xServerError:
+			err = parseXError(message, &xinformation)
+		default:
+			err = fmt.Errorf("unexpected X Protocol message type %d", messageType)
+		}
+		if err != nil {
+			xinformation.IsXProtocol = false
+			xinformation.Errormessage = err.Error()
+		}
+		return xinformation
+	}
+	xinformation.Errormessage = "too many X Protocol notices"
+	return xinformation
+}
+
+// readXMessage reads one X Protocol frame: a 4-byte little-endian length
+// covering the type byte and the message that follows it.
+func readXMessage(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length == 0 || length > maxPacketLength {
+		return 0, nil, fmt.Errorf("not an X Protocol frame length: %d", length)
+	}
+	message := make([]byte, length-1)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return 0, nil, err
+	}
+	return header[4], message, nil
+}
+
+// parseXCapabilities decodes Mysqlx.Connection.Capabilities.
+func parseXCapabilities(message []byte, xinformation *XProtocolInformation) error {
+	fields, err := parseProtoFields(message)
+	if err != nil {
+		return err
+	}
+
+	xinformation.IsXProtocol = true
+	xinformation.Capabilities = make(map[string]interface{})
+	for _, field := range fields {
+		if field.number != 1 || field.wireType != protoBytes {
+			continue
+		}
+		// Capability
+		capabilityFields, err := parseProtoFields(field.data)
+		if err != nil {
+			return err
+		}
+		var name string
+		var value interface{}
+		for _, capabilityField := range capabilityFields {
+			switch capabilityField.number {
+			case 1:
+				name = string(capabilityField.data)
+			case 2:
+				if value, err = parseXAny(capabilityField.data); err != nil {
+					return err
+				}
+			}
+		}
+		xinformation.Capabilities[name] = value
+	}
+
+	// Well-known Capabilities
+	xinformation.TLS, _ = xinformation.Capabilities["tls"].(bool)
+	xinformation.AuthenticationMechanisms = xStrings(xinformation.Capabilities["authentication.mechanisms"])
+	xinformation.DocFormats, _ = xinformation.Capabilities["doc.formats"].(string)
+	if compression, ok := xinformation.Capabilities["compression"].(map[string]interface{}); ok {
+		xinformation.CompressionAlgorithms = xStrings(compression["algorithm"])
+	}
+	xinformation.NodeType, _ = xinformation.Capabilities["node_type"].(string)
+	xinformation.ClientInteractive, _ = xinformation.Capabilities["client.interactive"].(bool)
+	return nil
+}
+
+// parseXError decodes Mysqlx.Error. A server that answers CapabilitiesGet
+// with an error still speaks the X Protocol.
+func parseXError(message []byte, xinformation *XProtocolInformation) error {
+	fields, err := parseProtoFields(message)
+	if err != nil {
+		return err
+	}
+	xinformation.IsXProtocol = true
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			xinformation.Errorcode = uint16(field.value)
+		case 3:
+			xinformation.Errormessage = string(field.data)
+		case 4:
+			xinformation.SQLState = string(field.data)
+		}
+	}
+	return nil
+}
+
+// parseXAny decodes Mysqlx.Datatypes.Any into a bool, number, string, nil,
+// []interface{} or map[string]interface{}.
+func parseXAny(message []byte) (interface{}, error) {
+	fields, err := parseProtoFields(message)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			return parseXScalar(field.data)
+		case 3:
+			// Object
+			objectFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return nil, err
+			}
+			object := make(map[string]interface{})
+			for _, objectField := range objectFields {
+				keyFields, err := parseProtoFields(objectField.data)
+				if err != nil {
+					return nil, err
+				}
+				var key string
+				var value interface{}
+				for _, keyField := range keyFields {
+					switch keyField.number {
+					case 1:
+						key = string(keyField.data)
+					case 2:
+						if value, err = parseXAny(keyField.data); err != nil {
+							return nil, err
+						}
+					}
+				}
+				object[key] = value
+			}
+			return object, nil
+		case 4:
+			// Array
+			arrayFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return nil, err
+			}
+			array := []interface{}{}
+			for _, arrayField := range arrayFields {
+				value, err := parseXAny(arrayField.data)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			return array, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseXScalar decodes Mysqlx.Datatypes.Scalar.
+func parseXScalar(message []byte) (interface{}, error) {
+	fields, err := parseProtoFields(message)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			// Zig-zag encoded signed integer
+			return int64(field.value>>1) ^ -int64(field.value&1), nil
+		case 3:
+			return field.value, nil
+		case 5, 9:
+			// Octets and String hold their bytes in field 1
+			valueFields, err := parseProtoFields(field.data)
+			if err != nil {
+				return nil, err
+			}
+			for _, valueField := range valueFields {
+				if valueField.number == 1 {
+					return string(valueField.data), nil
+				}
+			}
+			return "", nil
+		case 6:
+			return math.Float64frombits(field.value), nil
+		case 7:
+			return float64(math.Float32frombits(uint32(field.value))), nil
+		case 8:
+			return field.value != 0, nil
+		}
+	}
+	return nil, nil
+}
+
+// xStrings returns the strings in an array capability, or a single string
+// capability as a one element list.
+func xStrings(value interface{}) []string {
+	var values []string
+	switch value := value.(type) {
+	case string:
+		values = append(values, value)
+	case []interface{}:
+		for _, element := range value {
+			if element, ok := element.(string); ok {
+				values = append(values, element)
+			}
+		}
+	}
+	return values
+}
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoField is one field of a protobuf message. Varint and fixed width
+// values are held in value, and length-delimited ones in data.
+type protoField struct {
+	number   uint64
+	wireType byte
+	value    uint64
+	data     []byte
+}
+
+// parseProtoFields splits a protobuf message into its fields, without a
+// schema.
+func parseProtoFields(message []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field key")
+		}
+		message = message[n:]
+		field := protoField{number: key >> 3, wireType: byte(key & 7)}
+
+		switch field.wireType {
+		case protoVarint:
+			if field.value, n = binary.Uvarint(message); n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			message = message[n:]
+		case protoFixed64:
+			if len(message) < 8 {
+				return nil, errors.New("truncated protobuf fixed64")
+			}
+			field.value = binary.LittleEndian.Uint64(message)
+			message = message[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return nil, errors.New("truncated protobuf bytes")
+			}
+			field.data = message[n : n+int(length)]
+			message = message[n+int(length):]
+		case protoFixed32:
+			if len(message) < 4 {
+				return nil, errors.New("truncated protobuf fixed32")
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(message))
+			message = message[4:]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", field.wireType)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
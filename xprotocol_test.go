@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Grant Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mysqlscanner
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// protoVarintField encodes a varint field.
+func protoVarintField(number uint64, value uint64) []byte {
+	field := binary.AppendUvarint(nil, number<<3|protoVarint)
+	return binary.AppendUvarint(field, value)
+}
+
+// protoBytesField encodes a length-delimited field holding the concatenated
+// parts.
+func protoBytesField(number uint64, parts ...[]byte) []byte {
+	data := concatBytes(parts...)
+	field := binary.AppendUvarint(nil, number<<3|protoBytes)
+	field = binary.AppendUvarint(field, uint64(len(data)))
+	return append(field, data...)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var joined []byte
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return joined
+}
+
+// xScalar encodes a Mysqlx.Datatypes.Any holding a scalar of scalarType
+// with its value in field.
+func xScalar(scalarType uint64, field []byte) []byte {
+	return protoBytesField(2, protoVarintField(1, scalarType), field)
+}
+
+// xString encodes a Mysqlx.Datatypes.Any holding a string scalar.
+func xString(value string) []byte {
+	return xScalar(8, protoBytesField(9, protoBytesField(1, []byte(value))))
+}
+
+// xArray encodes a Mysqlx.Datatypes.Any holding an array of values.
+func xArray(values ...[]byte) []byte {
+	var elements [][]byte
+	for _, value := range values {
+		elements = append(elements, protoBytesField(1, value))
+	}
+	return protoBytesField(4, elements...)
+}
+
+// xCapability encodes a Mysqlx.Connection.Capability.
+func xCapability(name string, value []byte) []byte {
+	return protoBytesField(1, protoBytesField(1, []byte(name)), protoBytesField(2, value))
+}
+
+// xFrame wraps message in an X Protocol frame.
+func xFrame(messageType byte, message []byte) []byte {
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(message)+1))
+	return append(append(frame, messageType), message...)
+}
+
+// testXCapabilities is a MySQL 8.0 reply to CapabilitiesGet, preceded by a
+// notice.
+var testXCapabilities = concatBytes(
+	xFrame(xServerNotice, protoVarintField(1, 3)),
+	xFrame(xServerCapabilities, concatBytes(
+		xCapability("tls", xScalar(7, protoVarintField(8, 1))),
+		xCapability("authentication.mechanisms", xArray(xString("MYSQL41"), xString("SHA256_MEMORY"))),
+		xCapability("doc.formats", xString("text")),
+		xCapability("compression", protoBytesField(3, protoBytesField(1,
+			protoBytesField(1, []byte("algorithm")), protoBytesField(2, xArray(xString("zstd_stream")))))),
+		xCapability("node_type", xString("mysql")),
+		xCapability("client.interactive", xScalar(7, protoVarintField(8, 0))),
+		xCapability("read_timeout", xScalar(1, protoVarintField(2, 5))),
+	)),
+)
+
+func TestParseXCapabilities(t *testing.T) {
+	xinformation := xprotocolModule{}.Parse(testXCapabilities).(XProtocolInformation)
+	if xinformation.Errormessage != "" {
+		t.Fatalf("Parse: %s", xinformation.Errormessage)
+	}
+	if !xinformation.IsXProtocol || !xinformation.TLS || xinformation.DocFormats != "text" ||
+		xinformation.NodeType != "mysql" || xinformation.ClientInteractive {
+		t.Errorf("got %+v", xinformation)
+	}
+	if want := []string{"MYSQL41", "SHA256_MEMORY"}; !reflect.DeepEqual(xinformation.AuthenticationMechanisms, want) {
+		t.Errorf("got mechanisms %v, want %v", xinformation.AuthenticationMechanisms, want)
+	}
+	if want := []string{"zstd_stream"}; !reflect.DeepEqual(xinformation.CompressionAlgorithms, want) {
+		t.Errorf("got compression %v, want %v", xinformation.CompressionAlgorithms, want)
+	}
+	if timeout := xinformation.Capabilities["read_timeout"]; timeout != int64(-3) {
+		t.Errorf("got zig-zag integer %v, want -3", timeout)
+	}
+}
+
+func TestParseXError(t *testing.T) {
+	message := concatBytes(protoVarintField(1, 1), protoVarintField(2, 5001),
+		protoBytesField(3, []byte("Capabilities prepare failed")), protoBytesField(4, []byte("HY000")))
+	xinformation := xprotocolModule{}.Parse(xFrame(xServerError, message)).(XProtocolInformation)
+	want := XProtocolInformation{IsXProtocol: true, Errorcode: 5001, SQLState: "HY000", Errormessage: "Capabilities prepare failed"}
+	if !reflect.DeepEqual(xinformation, want) {
+		t.Errorf("got %+v, want %+v", xinformation, want)
+	}
+}
+
+// TestParseXCapabilitiesTruncated cuts the reply at every length, which must
+// give an error rather than a partial record or a panic.
+func TestParseXCapabilitiesTruncated(t *testing.T) {
+	for length := 0; length < len(testXCapabilities); length++ {
+		xinformation := xprotocolModule{}.Parse(testXCapabilities[:length]).(XProtocolInformation)
+		if xinformation.Errormessage == "" || xinformation.IsXProtocol {
+			t.Fatalf("Parse(%d bytes) = %+v, want an error", length, xinformation)
+		}
+	}
+
+	// A frame whose length covers a truncated capability
+	frame := xFrame(xServerCapabilities, protoBytesField(1, protoBytesField(1, []byte("tls")))[:6])
+	if xinformation := (xprotocolModule{}).Parse(frame).(XProtocolInformation); xinformation.Errormessage == "" {
+		t.Errorf("Parse(truncated capability) = %+v, want an error", xinformation)
+	}
+}
+
+func TestXProtocolProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, 5)
+		conn.Read(request)
+		conn.Write(testXCapabilities)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	xinformation := xprotocolModule{}.Probe(conn, Config{Timeout: 2}).(XProtocolInformation)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	if !xinformation.IsXProtocol || xinformation.IPAddress != host || xinformation.DstPort != port {
+		t.Errorf("got %+v from %s", xinformation, listener.Addr())
+	}
+}